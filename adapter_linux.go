@@ -0,0 +1,12 @@
+package main
+
+import "tinygo.org/x/bluetooth"
+
+// newAdapter returns the BlueZ adapter with the given id, or the default
+// adapter when id is empty.
+func newAdapter(id string) (*bluetooth.Adapter, error) {
+	if id == "" {
+		return bluetooth.DefaultAdapter, nil
+	}
+	return bluetooth.NewAdapter(id), nil
+}
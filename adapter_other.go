@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// newAdapter returns the default adapter. Selecting an adapter by id is
+// only supported by BlueZ.
+func newAdapter(id string) (*bluetooth.Adapter, error) {
+	if id != "" {
+		return nil, errors.New("bluetooth.adapter is only supported on Linux")
+	}
+	return bluetooth.DefaultAdapter, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import "fmt"
+
+// Appearance values are a 10-bit category and a 6-bit subcategory, as
+// listed in section 2.6 of the Bluetooth SIG Assigned Numbers.
+var appearanceCategories = map[uint16]string{
+	0x000: "unknown",
+	0x001: "phone",
+	0x002: "computer",
+	0x003: "watch",
+	0x004: "clock",
+	0x005: "display",
+	0x006: "remote control",
+	0x007: "eyeglasses",
+	0x008: "tag",
+	0x009: "keyring",
+	0x00A: "media player",
+	0x00B: "barcode scanner",
+	0x00C: "thermometer",
+	0x00D: "heart rate sensor",
+	0x00E: "blood pressure monitor",
+	0x00F: "human interface device",
+	0x010: "glucose meter",
+	0x011: "running walking sensor",
+	0x012: "cycling sensor",
+	0x013: "control device",
+	0x014: "network device",
+	0x015: "sensor",
+	0x016: "light fixture",
+	0x017: "fan",
+	0x018: "hvac",
+	0x019: "air conditioning",
+	0x01A: "humidifier",
+	0x01B: "heating",
+	0x01C: "access control",
+	0x01D: "motorized device",
+	0x01E: "power device",
+	0x01F: "light source",
+	0x020: "window covering",
+	0x021: "audio sink",
+	0x022: "audio source",
+	0x023: "motorized vehicle",
+	0x024: "domestic appliance",
+	0x025: "wearable audio device",
+	0x026: "aircraft",
+	0x027: "av equipment",
+	0x028: "display equipment",
+	0x029: "hearing aid",
+	0x02A: "gaming",
+	0x02B: "signage",
+	0x031: "pulse oximeter",
+	0x032: "weight scale",
+	0x033: "personal mobility device",
+	0x034: "continuous glucose monitor",
+	0x035: "insulin pump",
+	0x036: "medication delivery",
+	0x037: "spirometer",
+	0x051: "outdoor sports activity",
+}
+
+// appearanceSubcategories names the subcategories that say more about a
+// device than its category, keyed by the full appearance value.
+var appearanceSubcategories = map[uint16]string{
+	0x00C1: "sports watch",
+	0x00C2: "smartwatch",
+	0x03C1: "keyboard",
+	0x03C2: "mouse",
+	0x03C3: "joystick",
+	0x03C4: "gamepad",
+	0x03C5: "digitizer tablet",
+	0x03C6: "card reader",
+	0x03C7: "digital pen",
+	0x03C8: "barcode scanner",
+	0x03C9: "touchpad",
+	0x03CA: "presentation remote",
+	0x0541: "motion sensor",
+	0x0543: "temperature sensor",
+	0x0544: "humidity sensor",
+	0x0545: "leak sensor",
+	0x0546: "smoke sensor",
+	0x0547: "occupancy sensor",
+	0x0548: "contact sensor",
+	0x0941: "earbud",
+	0x0942: "headset",
+	0x0943: "headphones",
+	0x0944: "neck band",
+}
+
+// appearanceCategory returns a human readable kind of device for an
+// Appearance value, such as "phone", "smartwatch" or "headset".
+func appearanceCategory(a uint16) string {
+	if s, ok := appearanceSubcategories[a]; ok {
+		return s
+	}
+	if s, ok := appearanceCategories[a>>6]; ok {
+		return s
+	}
+	return fmt.Sprintf("reserved (0x%04x)", a)
+}
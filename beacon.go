@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Apple's iBeacon frame: type 0x02, length 0x15, proximity UUID, major
+// and minor in big endian and the measured power at 1m in dBm.
+const (
+	iBeaconType   = 0x02
+	iBeaconLength = 0x15
+)
+
+// AltBeacon frames start with the beacon code 0xBEAC, followed by a
+// 20-byte beacon ID, the reference RSSI at 1m and a reserved byte. They
+// may carry any company identifier.
+const altBeaconCode = 0xBEAC
+
+func decodeIBeacon(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) < 2 || data[0] != iBeaconType || data[1] != iBeaconLength {
+		return nil, nil
+	}
+	if len(data) < 2+iBeaconLength {
+		return nil, fmt.Errorf("ibeacon: frame too short: %d bytes", len(data))
+	}
+	return beaconDecoded(data[2:18], binary.BigEndian.Uint16(data[18:]), binary.BigEndian.Uint16(data[20:]), int8(data[22])), nil
+}
+
+func decodeAltBeacon(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != altBeaconCode {
+		return nil, nil
+	}
+	if len(data) < 24 {
+		return nil, fmt.Errorf("altbeacon: frame too short: %d bytes", len(data))
+	}
+	// The beacon ID is conventionally split like an iBeacon's.
+	d := beaconDecoded(data[2:18], binary.BigEndian.Uint16(data[18:]), binary.BigEndian.Uint16(data[20:]), int8(data[22]))
+	d.Fields["manufacturer_reserved"] = data[23]
+	return d, nil
+}
+
+// beaconDecoded returns a beacon identified by its UUID, major and minor
+// rather than its address, which many beacons rotate.
+func beaconDecoded(uuid []byte, major, minor uint16, power int8) *Decoded {
+	u := formatBeaconUUID(uuid)
+	return &Decoded{
+		ID: u + "/" + strconv.Itoa(int(major)) + "/" + strconv.Itoa(int(minor)),
+		Tags: map[string]string{
+			"uuid":  u,
+			"major": strconv.Itoa(int(major)),
+			"minor": strconv.Itoa(int(minor)),
+		},
+		Fields: map[string]interface{}{"measured_power": power},
+	}
+}
+
+// formatBeaconUUID formats the 16 bytes of a proximity UUID in network
+// order as a lower-case UUID string.
+func formatBeaconUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// BeaconConfig configures region monitoring of iBeacons and AltBeacons.
+type BeaconConfig struct {
+	// ExitTimeout is how long no beacon of a region may be seen before
+	// the region is left, unless the region sets its own.
+	ExitTimeout Duration `json:"exit_timeout"`
+
+	Regions []BeaconRegion `json:"regions"`
+}
+
+// BeaconRegion matches beacons by proximity UUID and optionally major
+// and minor.
+type BeaconRegion struct {
+	Name        string   `json:"name"`
+	UUID        string   `json:"uuid"`
+	Major       *uint16  `json:"major,omitempty"`
+	Minor       *uint16  `json:"minor,omitempty"`
+	ExitTimeout Duration `json:"exit_timeout,omitempty"`
+}
+
+func (c BeaconConfig) validate() error {
+	var errs []error
+	if c.ExitTimeout < Duration(time.Second) {
+		errs = append(errs, errors.New("beacons.exit_timeout must be at least 1s"))
+	}
+	names := make(map[string]bool)
+	for i, r := range c.Regions {
+		field := fmt.Sprintf("beacons.regions[%d]", i)
+		if r.Name == "" {
+			errs = append(errs, errors.New(field+".name is required"))
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is not unique", field, r.Name))
+		}
+		names[r.Name] = true
+		if _, err := bluetooth.ParseUUID(r.UUID); err != nil {
+			errs = append(errs, fmt.Errorf("%s.uuid: invalid UUID %q", field, r.UUID))
+		}
+		if r.Minor != nil && r.Major == nil {
+			errs = append(errs, errors.New(field+".minor requires major"))
+		}
+		if r.ExitTimeout != 0 && r.ExitTimeout < Duration(time.Second) {
+			errs = append(errs, errors.New(field+".exit_timeout must be at least 1s"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *BeaconRegion) matches(d Decoded) bool {
+	if !strings.EqualFold(d.Tags["uuid"], r.UUID) {
+		return false
+	}
+	if r.Major != nil && d.Tags["major"] != strconv.Itoa(int(*r.Major)) {
+		return false
+	}
+	if r.Minor != nil && d.Tags["minor"] != strconv.Itoa(int(*r.Minor)) {
+		return false
+	}
+	return true
+}
+
+// RegionEvent is emitted when a region is entered or left.
+type RegionEvent struct {
+	Time   time.Time
+	Host   string
+	Region string
+
+	// Event is "enter" or "exit". Beacon is the beacon that entered the
+	// region or was the last one seen before leaving it.
+	Event  string
+	Beacon string
+
+	// Duration is the time spent in the region, on exit.
+	Duration time.Duration
+}
+
+func (e RegionEvent) Measurement() string { return "region" }
+
+func (e RegionEvent) Tags() map[string]string {
+	return map[string]string{"region": e.Region, "host": e.Host}
+}
+
+func (e RegionEvent) Fields() map[string]interface{} {
+	f := map[string]interface{}{"event": e.Event, "beacon": e.Beacon}
+	if e.Event == "exit" {
+		f["duration"] = e.Duration.Seconds()
+	}
+	return f
+}
+
+func (e RegionEvent) Timestamp() time.Time { return e.Time }
+
+// regionMonitor tracks which beacon regions are currently in range.
+type regionMonitor struct {
+	config BeaconConfig
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	inside map[string]*regionState
+}
+
+type regionState struct {
+	entered  time.Time
+	lastSeen time.Time
+	beacon   string
+}
+
+// newRegionMonitor monitors the regions of c, leaving those that timed
+// out on every tick. A nil tick ticks every second.
+func newRegionMonitor(c BeaconConfig, tick <-chan time.Time) *regionMonitor {
+	m := &regionMonitor{
+		config: c,
+		done:   make(chan struct{}),
+		inside: make(map[string]*regionState),
+	}
+	if len(c.Regions) > 0 {
+		m.wg.Add(1)
+		go m.run(tick)
+	}
+	return m
+}
+
+// Observe updates the regions with a beacon decoded from an
+// advertisement received at t.
+func (m *regionMonitor) Observe(t time.Time, d Decoded) {
+	if d.ID == "" {
+		return
+	}
+	for i := range m.config.Regions {
+		r := &m.config.Regions[i]
+		if !r.matches(d) {
+			continue
+		}
+		m.mu.Lock()
+		s, ok := m.inside[r.Name]
+		if !ok {
+			s = &regionState{entered: t}
+			m.inside[r.Name] = s
+		}
+		if t.After(s.lastSeen) {
+			s.lastSeen = t
+			s.beacon = d.ID
+		}
+		m.mu.Unlock()
+		if !ok {
+			m.emit(RegionEvent{Time: t, Host: hostname, Region: r.Name, Event: "enter", Beacon: d.ID})
+		}
+	}
+}
+
+func (m *regionMonitor) run(tick <-chan time.Time) {
+	defer m.wg.Done()
+	if tick == nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-tick:
+			m.expire(now)
+		}
+	}
+}
+
+// expire leaves the regions whose beacons have not been seen for their
+// exit timeout at now.
+func (m *regionMonitor) expire(now time.Time) {
+	var exits []RegionEvent
+	m.mu.Lock()
+	for _, r := range m.config.Regions {
+		s, ok := m.inside[r.Name]
+		if !ok {
+			continue
+		}
+		timeout := r.ExitTimeout
+		if timeout == 0 {
+			timeout = m.config.ExitTimeout
+		}
+		if now.Sub(s.lastSeen) < time.Duration(timeout) {
+			continue
+		}
+		delete(m.inside, r.Name)
+		exits = append(exits, RegionEvent{
+			Time:     now,
+			Host:     hostname,
+			Region:   r.Name,
+			Event:    "exit",
+			Beacon:   s.beacon,
+			Duration: s.lastSeen.Sub(s.entered),
+		})
+	}
+	m.mu.Unlock()
+	for _, e := range exits {
+		m.emit(e)
+	}
+}
+
+func (m *regionMonitor) emit(e RegionEvent) {
+	l := scanLog.WithField("region", e.Region).WithField("beacon", e.Beacon)
+	if e.Event == "exit" {
+		l = l.WithField("duration", e.Duration)
+	}
+	l.Info("region " + e.Event)
+	metrics.Add("region_"+e.Event+"s", 1)
+	writeEvent(sinkLog.WithField("region", e.Region), e)
+}
+
+// Close stops monitoring. Regions still in range are not left.
+func (m *regionMonitor) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
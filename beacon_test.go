@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecodeBeacons(t *testing.T) {
+	const (
+		uuid  = "e2c56db5dffb48d2b060d0f5a71096e0"
+		id    = "e2c56db5-dffb-48d2-b060-d0f5a71096e0/1/258"
+		ibeac = "0215" + uuid + "00010102c5"
+		alt   = "beac" + uuid + "00010102c5a7"
+	)
+	for _, tt := range []struct {
+		name   string
+		decode func(Advertisement, uint16, []byte) (*Decoded, error)
+		data   string
+		fields map[string]interface{} // nil if not decoded
+		err    bool
+	}{
+		{name: "ibeacon", decode: decodeIBeacon, data: ibeac,
+			fields: map[string]interface{}{"measured_power": int8(-59)}},
+		{name: "ibeacon trailing byte", decode: decodeIBeacon, data: ibeac + "00",
+			fields: map[string]interface{}{"measured_power": int8(-59)}},
+		{name: "ibeacon too short", decode: decodeIBeacon, data: ibeac[:len(ibeac)-2], err: true},
+		{name: "ibeacon header only", decode: decodeIBeacon, data: "0215", err: true},
+		{name: "ibeacon wrong type", decode: decodeIBeacon, data: "12" + ibeac[2:]},
+		{name: "ibeacon wrong length", decode: decodeIBeacon, data: "0216" + ibeac[4:]},
+		{name: "ibeacon empty", decode: decodeIBeacon, data: ""},
+		{name: "altbeacon", decode: decodeAltBeacon, data: alt,
+			fields: map[string]interface{}{"measured_power": int8(-59), "manufacturer_reserved": byte(0xa7)}},
+		{name: "altbeacon too short", decode: decodeAltBeacon, data: alt[:len(alt)-2], err: true},
+		{name: "altbeacon wrong code", decode: decodeAltBeacon, data: "beab" + alt[4:]},
+		{name: "altbeacon one byte", decode: decodeAltBeacon, data: "be"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := tt.decode(Advertisement{}, 0x004C, mustHex(t, tt.data))
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error: %v", err, tt.err)
+			}
+			if tt.fields == nil {
+				if d != nil {
+					t.Errorf("decoded %+v, want nothing", d)
+				}
+				return
+			}
+			if d == nil {
+				t.Fatal("not decoded")
+			}
+			if d.ID != id || d.Tags["uuid"] != id[:36] || d.Tags["major"] != "1" || d.Tags["minor"] != "258" {
+				t.Errorf("id %q, tags %v", d.ID, d.Tags)
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+// eventSink records the events written to it.
+type eventSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *eventSink) Write(ctx context.Context, ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func (s *eventSink) Close() error { return nil }
+
+// take returns the events written since the last call.
+func (s *eventSink) take() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+func TestRegionMonitor(t *testing.T) {
+	oldSink, oldHostname := sink, hostname
+	t.Cleanup(func() { sink, hostname = oldSink, oldHostname })
+	events := &eventSink{}
+	sink, hostname = events, "test-host"
+
+	const uuid = "E2C56DB5-DFFB-48D2-B060-D0F5A71096E0"
+	major, minor := uint16(1), uint16(2)
+	tick := make(chan time.Time)
+	m := newRegionMonitor(BeaconConfig{
+		ExitTimeout: Duration(30 * time.Second),
+		Regions: []BeaconRegion{
+			{Name: "building", UUID: uuid},
+			{Name: "floor", UUID: uuid, Major: &major},
+			{Name: "desk", UUID: uuid, Major: &major, Minor: &minor, ExitTimeout: Duration(5 * time.Second)},
+		},
+	}, tick)
+	defer m.Close()
+
+	beacon := func(major, minor uint16) Decoded {
+		return *beaconDecoded(mustHex(t, "e2c56db5dffb48d2b060d0f5a71096e0"), major, minor, -59)
+	}
+	check := func(step string, want ...RegionEvent) {
+		t.Helper()
+		got := events.take()
+		if len(got) != len(want) {
+			t.Fatalf("%s: events %+v, want %+v", step, got, want)
+		}
+		for i, ev := range got {
+			if e, ok := ev.(RegionEvent); !ok || e != want[i] {
+				t.Errorf("%s: event %+v, want %+v", step, ev, want[i])
+			}
+		}
+	}
+
+	t0 := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	desk, other := beacon(1, 2).ID, beacon(2, 7).ID
+	m.Observe(t0, beacon(1, 2))
+	check("first match",
+		RegionEvent{Time: t0, Host: "test-host", Region: "building", Event: "enter", Beacon: desk},
+		RegionEvent{Time: t0, Host: "test-host", Region: "floor", Event: "enter", Beacon: desk},
+		RegionEvent{Time: t0, Host: "test-host", Region: "desk", Event: "enter", Beacon: desk})
+	m.Observe(t0.Add(time.Second), beacon(1, 2))
+	check("same beacon")
+	m.Observe(t0.Add(2*time.Second), beacon(2, 7))
+	m.Observe(t0.Add(2*time.Second), beacon(1, 3))
+	check("other major and minor")
+	m.Observe(t0.Add(2*time.Second), Decoded{ID: "other", Tags: map[string]string{"uuid": "f7826da6-4fa2-4e98-8024-bc5b71e0893e", "major": "1", "minor": "2"}})
+	check("other uuid")
+
+	// The desk times out 5s after its beacon was last seen, the others
+	// after the default 30s.
+	m.expire(t0.Add(5 * time.Second))
+	check("before the region timeout")
+	m.expire(t0.Add(6 * time.Second))
+	check("region timeout", RegionEvent{Time: t0.Add(6 * time.Second), Host: "test-host", Region: "desk", Event: "exit", Beacon: desk, Duration: time.Second})
+	m.expire(t0.Add(31 * time.Second))
+	check("before the default timeout")
+
+	// Exits are checked on every tick. The second tick is only received
+	// once the first has been handled.
+	tick <- t0.Add(32 * time.Second)
+	tick <- t0.Add(33 * time.Second)
+	check("default timeout",
+		RegionEvent{Time: t0.Add(32 * time.Second), Host: "test-host", Region: "building", Event: "exit", Beacon: other, Duration: 2 * time.Second},
+		RegionEvent{Time: t0.Add(32 * time.Second), Host: "test-host", Region: "floor", Event: "exit", Beacon: beacon(1, 3).ID, Duration: 2 * time.Second})
+	m.Observe(t0.Add(40*time.Second), beacon(2, 7))
+	check("enter again", RegionEvent{Time: t0.Add(40 * time.Second), Host: "test-host", Region: "building", Event: "enter", Beacon: other})
+
+	exit := RegionEvent{Region: "desk", Event: "exit", Beacon: desk, Duration: 1500 * time.Millisecond}
+	if f := exit.Fields(); f["duration"] != 1.5 || f["beacon"] != desk {
+		t.Errorf("exit fields %v", f)
+	}
+	if _, ok := (RegionEvent{Event: "enter"}).Fields()["duration"]; ok {
+		t.Error("enter event has a duration")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// BTHome v2 service data, see https://bthome.io/format/. The first byte
+// holds the encryption flag (bit 0), the trigger based flag (bit 2) and
+// the version (bits 5-7), followed by objects of an ID and a little
+// endian value, in ID order.
+const (
+	bthomeEncrypted = 0x01
+	bthomeVersion   = 2
+)
+
+type bthomeKind int
+
+const (
+	bthomeSensor bthomeKind = iota
+	bthomeBinary
+	bthomeSpecial
+)
+
+// bthomeObject describes the value of an object ID: its field name and
+// size, whether it is signed and the factor that scales it to its unit.
+type bthomeObject struct {
+	name   string
+	size   int
+	signed bool
+	factor float64
+	kind   bthomeKind
+}
+
+func bthomeValue(name string, size int, signed bool, factor float64) bthomeObject {
+	return bthomeObject{name, size, signed, factor, bthomeSensor}
+}
+
+func bthomeBool(name string) bthomeObject {
+	return bthomeObject{name, 1, false, 1, bthomeBinary}
+}
+
+// bthomeObjects maps object IDs to their values. IDs handled by
+// decodeBTHomeSpecial have a size of zero when it is variable.
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {"packet_id", 1, false, 1, bthomeSpecial},
+	0x01: bthomeValue("battery_pct", 1, false, 1),
+	0x02: bthomeValue("temperature_c", 2, true, 0.01),
+	0x03: bthomeValue("humidity_pct", 2, false, 0.01),
+	0x04: bthomeValue("pressure", 3, false, 0.01),
+	0x05: bthomeValue("illuminance", 3, false, 0.01),
+	0x06: bthomeValue("mass_kg", 2, false, 0.01),
+	0x07: bthomeValue("mass_lb", 2, false, 0.01),
+	0x08: bthomeValue("dewpoint", 2, true, 0.01),
+	0x09: bthomeValue("count", 1, false, 1),
+	0x0A: bthomeValue("energy", 3, false, 0.001),
+	0x0B: bthomeValue("power", 3, false, 0.01),
+	0x0C: bthomeValue("voltage", 2, false, 0.001),
+	0x0D: bthomeValue("pm2_5", 2, false, 1),
+	0x0E: bthomeValue("pm10", 2, false, 1),
+	0x0F: bthomeBool("generic_boolean"),
+	0x10: bthomeBool("power_state"),
+	0x11: bthomeBool("opening"),
+	0x12: bthomeValue("co2", 2, false, 1),
+	0x13: bthomeValue("tvoc", 2, false, 1),
+	0x14: bthomeValue("moisture", 2, false, 0.01),
+	0x15: bthomeBool("battery_low"),
+	0x16: bthomeBool("battery_charging"),
+	0x17: bthomeBool("carbon_monoxide"),
+	0x18: bthomeBool("cold"),
+	0x19: bthomeBool("connectivity"),
+	0x1A: bthomeBool("door"),
+	0x1B: bthomeBool("garage_door"),
+	0x1C: bthomeBool("gas_detected"),
+	0x1D: bthomeBool("heat"),
+	0x1E: bthomeBool("light"),
+	0x1F: bthomeBool("lock"),
+	0x20: bthomeBool("moisture_detected"),
+	0x21: bthomeBool("motion"),
+	0x22: bthomeBool("moving"),
+	0x23: bthomeBool("occupancy"),
+	0x24: bthomeBool("plug"),
+	0x25: bthomeBool("presence"),
+	0x26: bthomeBool("problem"),
+	0x27: bthomeBool("running"),
+	0x28: bthomeBool("safety"),
+	0x29: bthomeBool("smoke"),
+	0x2A: bthomeBool("sound"),
+	0x2B: bthomeBool("tamper"),
+	0x2C: bthomeBool("vibration"),
+	0x2D: bthomeBool("window"),
+	0x2E: bthomeValue("humidity_pct", 1, false, 1),
+	0x2F: bthomeValue("moisture", 1, false, 1),
+	0x3A: {"button", 1, false, 1, bthomeSpecial},
+	0x3C: {"dimmer", 2, false, 1, bthomeSpecial},
+	0x3D: bthomeValue("count", 2, false, 1),
+	0x3E: bthomeValue("count", 4, false, 1),
+	0x3F: bthomeValue("rotation", 2, true, 0.1),
+	0x40: bthomeValue("distance_mm", 2, false, 1),
+	0x41: bthomeValue("distance_m", 2, false, 0.1),
+	0x42: bthomeValue("duration", 3, false, 0.001),
+	0x43: bthomeValue("current", 2, false, 0.001),
+	0x44: bthomeValue("speed", 2, false, 0.01),
+	0x45: bthomeValue("temperature_c", 2, true, 0.1),
+	0x46: bthomeValue("uv_index", 1, false, 0.1),
+	0x47: bthomeValue("volume", 2, false, 0.1),
+	0x48: bthomeValue("volume_ml", 2, false, 1),
+	0x49: bthomeValue("volume_flow_rate", 2, false, 0.001),
+	0x4A: bthomeValue("voltage", 2, false, 0.1),
+	0x4B: bthomeValue("gas", 3, false, 0.001),
+	0x4C: bthomeValue("gas", 4, false, 0.001),
+	0x4D: bthomeValue("energy", 4, false, 0.001),
+	0x4E: bthomeValue("volume", 4, false, 0.001),
+	0x4F: bthomeValue("water", 4, false, 0.001),
+	0x50: bthomeValue("timestamp", 4, false, 1),
+	0x51: bthomeValue("acceleration", 2, false, 0.001),
+	0x52: bthomeValue("gyroscope", 2, false, 0.001),
+	0x53: {"text", 0, false, 1, bthomeSpecial},
+	0x54: {"raw", 0, false, 1, bthomeSpecial},
+	0x55: bthomeValue("volume_storage", 4, false, 0.001),
+	0x56: bthomeValue("conductivity", 2, false, 1),
+	0x57: bthomeValue("temperature_c", 1, true, 1),
+	0x58: bthomeValue("temperature_c", 1, true, 0.35),
+	0x59: bthomeValue("count", 1, true, 1),
+	0x5A: bthomeValue("count", 2, true, 1),
+	0x5B: bthomeValue("count", 4, true, 1),
+	0x5C: bthomeValue("power", 4, true, 0.01),
+	0x5D: bthomeValue("current", 2, true, 0.001),
+	0x5E: bthomeValue("direction", 2, false, 0.01),
+	0x5F: bthomeValue("precipitation", 2, false, 0.1),
+	0x60: bthomeValue("channel", 1, false, 1),
+	0x61: bthomeValue("rotational_speed", 2, false, 1),
+	0xF0: {"device_type_id", 2, false, 1, bthomeSpecial},
+	0xF1: {"firmware_version", 4, false, 1, bthomeSpecial},
+	0xF2: {"firmware_version", 3, false, 1, bthomeSpecial},
+}
+
+// scale applies the factor, dividing for factors such as 0.01 so that
+// 5055 is 50.55 rather than 50.550000000000004.
+func (o bthomeObject) scale(v int64) float64 {
+	if d := math.Round(1 / o.factor); math.Abs(d*o.factor-1) < 1e-9 {
+		return float64(v) / d
+	}
+	return float64(v) * o.factor
+}
+
+var bthomeButtonEvents = map[byte]string{
+	0x01: "press",
+	0x02: "double_press",
+	0x03: "triple_press",
+	0x04: "long_press",
+	0x05: "long_double_press",
+	0x06: "long_triple_press",
+	0x80: "hold_press",
+}
+
+// decodeBTHome decodes BTHome v2 service data, decrypting it with the
+// bind key configured for the sender's address if it is encrypted.
+func decodeBTHome(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) == 0 || data[0]>>5 != bthomeVersion {
+		return nil, nil
+	}
+	info, payload := data[0], data[1:]
+	var counter *uint32
+	if info&bthomeEncrypted != 0 {
+		var err error
+		payload, counter, err = decryptBTHome(adv.Address, info, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Decoded{Measurement: "sensor", Fields: make(map[string]interface{}), Sequence: counter}
+	names := make(map[string]int)
+	field := func(name string) string {
+		names[name]++
+		if n := names[name]; n > 1 {
+			return name + "_" + strconv.Itoa(n)
+		}
+		return name
+	}
+	for len(payload) > 0 {
+		id := payload[0]
+		obj, ok := bthomeObjects[id]
+		if !ok {
+			// The size of an unknown object is unknown, so nothing after
+			// it can be decoded.
+			d.Fields["unknown_object_id"] = id
+			break
+		}
+		size := obj.size
+		if size == 0 && len(payload) > 1 {
+			size = 1 + int(payload[1])
+		}
+		if size == 0 || len(payload) < 1+size {
+			return nil, fmt.Errorf("bthome: object 0x%02x truncated", id)
+		}
+		value := payload[1 : 1+size]
+		payload = payload[1+size:]
+
+		switch obj.kind {
+		case bthomeSensor:
+			// Always a float, as objects of different factors share a
+			// field name and a field has one type in InfluxDB.
+			d.Fields[field(obj.name)] = obj.scale(bthomeInt(value, obj.signed))
+		case bthomeBinary:
+			d.Fields[field(obj.name)] = value[0] != 0
+		case bthomeSpecial:
+			decodeBTHomeSpecial(d, id, field(obj.name), value)
+		}
+	}
+	return d, nil
+}
+
+// decodeBTHomeSpecial decodes the objects that are not plain numbers:
+// the packet ID, events, text, raw data and device information.
+func decodeBTHomeSpecial(d *Decoded, id byte, name string, value []byte) {
+	switch id {
+	case 0x00:
+		// The encryption counter, if any, is the better sequence number.
+		if d.Sequence == nil {
+			seq := uint32(value[0])
+			d.Sequence = &seq
+		}
+	case 0x3A:
+		// Event 0x00 means no press, for the other buttons of a device.
+		if e, ok := bthomeButtonEvents[value[0]]; ok {
+			d.Events = append(d.Events, DeviceEvent{Name: name, Event: e})
+		} else if value[0] != 0x00 {
+			d.Events = append(d.Events, DeviceEvent{Name: name, Event: fmt.Sprintf("0x%02x", value[0])})
+		}
+	case 0x3C:
+		switch value[0] {
+		case 0x01:
+			d.Events = append(d.Events, DeviceEvent{Name: name, Event: "rotate_left", Steps: int(value[1])})
+		case 0x02:
+			d.Events = append(d.Events, DeviceEvent{Name: name, Event: "rotate_right", Steps: int(value[1])})
+		}
+	case 0x53:
+		d.Fields[name] = string(value[1:])
+	case 0x54:
+		d.Fields[name] = hex.EncodeToString(value[1:])
+	case 0xF0:
+		d.Fields[name] = int64(binary.LittleEndian.Uint16(value))
+	case 0xF1, 0xF2:
+		// Little endian, so the most significant part comes last.
+		parts := make([]string, len(value))
+		for i, b := range value {
+			parts[len(value)-1-i] = strconv.Itoa(int(b))
+		}
+		d.Fields[name] = strings.Join(parts, ".")
+	}
+}
+
+// bthomeInt reads a little endian integer of 1 to 4 bytes.
+func bthomeInt(b []byte, signed bool) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	if signed {
+		shift := 64 - 8*len(b)
+		return int64(u<<shift) >> shift
+	}
+	return int64(u)
+}
+
+// decryptBTHome decrypts an encrypted BTHome payload: the ciphertext,
+// a 4-byte counter and a 4-byte message integrity check. The AES-CCM
+// nonce is the sender's address, the service UUID, the device
+// information byte and the counter.
+func decryptBTHome(address string, info byte, payload []byte) ([]byte, *uint32, error) {
+	key, err := bindKey(cfg.Decode.BTHomeKeys, address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bthome: %w", err)
+	}
+	if len(payload) < 9 {
+		return nil, nil, errors.New("bthome: encrypted payload too short")
+	}
+	mac, err := addressBytes(address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bthome: %w", err)
+	}
+	n := len(payload)
+	ciphertext, count, mic := payload[:n-8], payload[n-8:n-4], payload[n-4:]
+	nonce := append(append(mac, 0xD2, 0xFC, info), count...)
+	plaintext, err := ccmOpen(key, nonce, ciphertext, mic, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bthome: %w", err)
+	}
+	counter := binary.LittleEndian.Uint32(count)
+	return plaintext, &counter, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// equalFields compares decoded fields, allowing for rounding in floats.
+func equalFields(got, want map[string]interface{}) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, w := range want {
+		g, ok := got[k]
+		if !ok {
+			return false
+		}
+		gf, gok := g.(float64)
+		wf, wok := w.(float64)
+		if gok && wok {
+			if math.Abs(gf-wf) > 1e-9 {
+				return false
+			}
+		} else if !reflect.DeepEqual(g, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeBTHome(t *testing.T) {
+	seq := func(n uint32) *uint32 { return &n }
+	tests := []struct {
+		name     string
+		data     string
+		fields   map[string]interface{}
+		events   []DeviceEvent
+		sequence *uint32
+		err      bool
+	}{
+		// The examples of https://bthome.io/format/.
+		{name: "temperature and humidity", data: "4002ca0903bf13", fields: map[string]interface{}{"temperature_c": 25.06, "humidity_pct": 50.55}},
+		{name: "battery_pct", data: "400161", fields: map[string]interface{}{"battery_pct": 97.0}},
+		{name: "pressure", data: "4004138a01", fields: map[string]interface{}{"pressure": 1008.83}},
+		{name: "illuminance", data: "4005138a14", fields: map[string]interface{}{"illuminance": 13460.67}},
+		{name: "energy", data: "400a138a14", fields: map[string]interface{}{"energy": 1346.067}},
+		{name: "power", data: "400b021b00", fields: map[string]interface{}{"power": 69.14}},
+		{name: "voltage", data: "400c020c", fields: map[string]interface{}{"voltage": 3.074}},
+		{name: "dewpoint", data: "4008ca06", fields: map[string]interface{}{"dewpoint": 17.38}},
+		{name: "count", data: "400960", fields: map[string]interface{}{"count": 96.0}},
+		{name: "co2", data: "4012e204", fields: map[string]interface{}{"co2": 1250.0}},
+		{name: "moisture", data: "4014020c", fields: map[string]interface{}{"moisture": 30.74}},
+		{name: "temperature 0.1", data: "40451301", fields: map[string]interface{}{"temperature_c": 27.5}},
+		{name: "signed temperature", data: "4057ea", fields: map[string]interface{}{"temperature_c": -22.0}},
+		{name: "temperature 0.35", data: "405822", fields: map[string]interface{}{"temperature_c": 11.9}},
+		{name: "signed count", data: "405a0cfc", fields: map[string]interface{}{"count": -1012.0}},
+		{name: "binary sensors", data: "40110121002d01", fields: map[string]interface{}{"opening": true, "motion": false, "window": true}},
+		{name: "text", data: "40530c48656c6c6f20576f726c6421", fields: map[string]interface{}{"text": "Hello World!"}},
+		{name: "raw", data: "40540c48656c6c6f20576f726c6421", fields: map[string]interface{}{"raw": "48656c6c6f20576f726c6421"}},
+		{name: "device information", data: "40f00100f100010204", fields: map[string]interface{}{"device_type_id": int64(1), "firmware_version": "4.2.1.0"}},
+		{name: "packet id", data: "40000902ca09", fields: map[string]interface{}{"temperature_c": 25.06}, sequence: seq(9)},
+		{name: "repeated objects", data: "4002ca0902c409", fields: map[string]interface{}{"temperature_c": 25.06, "temperature_c_2": 25.0}},
+		{name: "unknown object", data: "4002ca09fe01", fields: map[string]interface{}{"temperature_c": 25.06, "unknown_object_id": byte(0xfe)}},
+		{
+			name: "buttons", data: "403a013a003a04", fields: map[string]interface{}{},
+			events: []DeviceEvent{{Name: "button", Event: "press"}, {Name: "button_3", Event: "long_press"}},
+		},
+		{
+			name: "dimmer", data: "403c0103", fields: map[string]interface{}{},
+			events: []DeviceEvent{{Name: "dimmer", Event: "rotate_left", Steps: 3}},
+		},
+		{name: "truncated object", data: "4002ca", err: true},
+		{name: "encrypted without a key", data: "41a47266c95f730011223378237214", err: true},
+		{name: "version 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.BTHomeKeys = k }, nil)
+			data := mustHex(t, tt.data)
+			if tt.name == "version 1" {
+				data = mustHex(t, "2002ca09")
+			}
+			d, err := decodeBTHome(Advertisement{Address: "11:22:33:44:55:66"}, 0, data)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("decoded %+v, want an error", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.fields == nil {
+				if d != nil {
+					t.Fatalf("decoded %+v, want nil", d)
+				}
+				return
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+			if !reflect.DeepEqual(d.Events, tt.events) {
+				t.Errorf("events = %v, want %v", d.Events, tt.events)
+			}
+			if !reflect.DeepEqual(d.Sequence, tt.sequence) {
+				t.Errorf("sequence = %v, want %v", d.Sequence, tt.sequence)
+			}
+		})
+	}
+}
+
+// TestBTHomeFieldTypes checks that objects sharing a field name write
+// the same type whatever their factor, as InfluxDB rejects a field whose
+// type changes.
+func TestBTHomeFieldTypes(t *testing.T) {
+	for _, data := range []string{"4002ca09", "40451301", "4057ea", "405822", "4003bf13", "402e32", "4014020c", "402f32"} {
+		d, err := decodeBTHome(Advertisement{Address: "11:22:33:44:55:66"}, 0, mustHex(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range d.Fields {
+			if _, ok := v.(float64); !ok {
+				t.Errorf("%s: %s is %T, want float64", data, k, v)
+			}
+		}
+	}
+}
+
+// The encrypted example of https://bthome.io/encryption/.
+const (
+	bthomeExampleAddress = "54:48:E6:8F:80:A5"
+	bthomeExampleKey     = "231d39c1d7cc1ab1aee224cd096db932"
+	bthomeExampleData    = "41a47266c95f730011223378237214"
+)
+
+func TestDecryptBTHome(t *testing.T) {
+	testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.BTHomeKeys = k },
+		map[string]string{bthomeExampleAddress: bthomeExampleKey})
+	data := mustHex(t, bthomeExampleData)
+
+	plaintext, counter, err := decryptBTHome(bthomeExampleAddress, data[0], data[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "02ca0903bf13"); string(plaintext) != string(want) {
+		t.Errorf("plaintext = %x, want %x", plaintext, want)
+	}
+	if *counter != 0x33221100 {
+		t.Errorf("counter = %#x, want 0x33221100", *counter)
+	}
+
+	d, err := decodeBTHome(Advertisement{Address: bthomeExampleAddress}, 0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"temperature_c": 25.06, "humidity_pct": 50.55}; !equalFields(d.Fields, want) {
+		t.Errorf("fields = %v, want %v", d.Fields, want)
+	}
+	if d.Sequence == nil || *d.Sequence != 0x33221100 {
+		t.Errorf("sequence = %v, want the encryption counter", d.Sequence)
+	}
+
+	// Another device, or the wrong key, must fail authentication.
+	if _, _, err := decryptBTHome("54:48:E6:8F:80:A6", data[0], data[1:]); err == nil {
+		t.Error("decrypted without a key for the address")
+	}
+	testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.BTHomeKeys = k },
+		map[string]string{bthomeExampleAddress: "331d39c1d7cc1ab1aee224cd096db932"})
+	if _, _, err := decryptBTHome(bthomeExampleAddress, data[0], data[1:]); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// errCCMAuth is returned by ccmOpen for a payload that does not match its
+// tag, usually because the key is wrong.
+var errCCMAuth = errors.New("ccm: message authentication failed")
+
+// ccmOpen decrypts and authenticates ciphertext with AES-CCM as used by
+// Bluetooth advertisements (RFC 3610): a 7 to 13 byte nonce, a tag of
+// len(tag) bytes and optional additional data. The standard library has
+// no CCM mode and these payloads are tiny, so it is done here by hand.
+func ccmOpen(key, nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	l := 15 - len(nonce)
+	if l < 2 || l > 8 || len(tag) < 4 || len(tag) > 16 || len(tag)%2 != 0 {
+		return nil, errors.New("ccm: invalid nonce or tag size")
+	}
+	if l < 8 && len(ciphertext) >= 1<<(8*l) {
+		return nil, errors.New("ccm: message too long")
+	}
+
+	// Counter block i is the flags L-1, the nonce and i in L bytes.
+	ctr := make([]byte, aes.BlockSize)
+	ctr[0] = byte(l - 1)
+	copy(ctr[1:], nonce)
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, ctr)
+	ctr[aes.BlockSize-1] = 1
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, ctr).XORKeyStream(plaintext, ciphertext)
+
+	// CBC-MAC over B0, the length-prefixed additional data and the
+	// plaintext, each padded with zeros to the block size.
+	mac := make([]byte, aes.BlockSize)
+	mac[0] = byte((len(tag)-2)/2<<3 | (l - 1))
+	if len(aad) > 0 {
+		mac[0] |= 0x40
+	}
+	copy(mac[1:], nonce)
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(ciphertext)))
+	copy(mac[1+len(nonce):], size[8-l:])
+	block.Encrypt(mac, mac)
+	var adata []byte
+	if len(aad) > 0 {
+		if len(aad) >= 0xFF00 {
+			return nil, errors.New("ccm: additional data too long")
+		}
+		adata = binary.BigEndian.AppendUint16(nil, uint16(len(aad)))
+		adata = append(adata, aad...)
+	}
+	for _, data := range [][]byte{adata, plaintext} {
+		for len(data) > 0 {
+			var b [aes.BlockSize]byte
+			n := copy(b[:], data)
+			data = data[n:]
+			subtle.XORBytes(mac, mac, b[:])
+			block.Encrypt(mac, mac)
+		}
+	}
+
+	subtle.XORBytes(mac, mac, s0)
+	if subtle.ConstantTimeCompare(mac[:len(tag)], tag) != 1 {
+		return nil, errCCMAuth
+	}
+	return plaintext, nil
+}
+
+// bindKey returns the 16-byte AES key configured for address in keys.
+func bindKey(keys map[string]*Secret, address string) ([]byte, error) {
+	s, ok := keys[strings.ToUpper(address)]
+	if !ok {
+		return nil, errors.New("no key configured for " + address)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(s.Value()))
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("key for " + address + " is not 32 hex digits")
+	}
+	return key, nil
+}
+
+// addressBytes parses a MAC address such as "A4:C1:38:01:02:03" into its
+// six bytes in the order written.
+func addressBytes(address string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(address, ":", ""))
+	if err != nil || len(b) != 6 {
+		return nil, errors.New("not a MAC address: " + address)
+	}
+	return b, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// testKeys installs keys as the bind keys of the decode config for the
+// duration of the test.
+func testKeys(t *testing.T, set func(*DecodeConfig, map[string]*Secret), keys map[string]string) {
+	t.Helper()
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg = &Config{}
+	secrets := make(map[string]*Secret)
+	for addr, k := range keys {
+		secrets[addr] = &Secret{ref: "env:TEST_KEY", value: k}
+	}
+	set(&cfg.Decode, secrets)
+}
+
+// ccmSeal encrypts and authenticates plaintext with AES-CCM, written
+// independently of ccmOpen from RFC 3610 section 2.2 so that it can build
+// encrypted frames for the decoder tests.
+func ccmSeal(t *testing.T, key, nonce, plaintext, aad []byte, tagSize int) (ciphertext, tag []byte) {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := 15 - len(nonce)
+	encrypt := func(b []byte) []byte {
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, b)
+		return out
+	}
+	counterBlock := func(i int) []byte {
+		a := make([]byte, aes.BlockSize)
+		a[0] = byte(l - 1)
+		copy(a[1:], nonce)
+		for j := 0; j < l; j++ {
+			a[aes.BlockSize-1-j] = byte(i >> (8 * j))
+		}
+		return encrypt(a)
+	}
+
+	b0 := make([]byte, aes.BlockSize)
+	b0[0] = byte((tagSize-2)/2<<3 | (l - 1))
+	if len(aad) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	for j := 0; j < l; j++ {
+		b0[aes.BlockSize-1-j] = byte(len(plaintext) >> (8 * j))
+	}
+	pad := func(b []byte) []byte {
+		for len(b)%aes.BlockSize != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	msg := append([]byte{}, b0...)
+	if len(aad) > 0 {
+		msg = append(msg, pad(append([]byte{byte(len(aad) >> 8), byte(len(aad))}, aad...))...)
+	}
+	msg = append(msg, pad(append([]byte{}, plaintext...))...)
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < len(msg); i += aes.BlockSize {
+		for j := range x {
+			x[j] ^= msg[i+j]
+		}
+		x = encrypt(x)
+	}
+
+	ciphertext = make([]byte, len(plaintext))
+	for i := range plaintext {
+		ciphertext[i] = plaintext[i] ^ counterBlock(1 + i/aes.BlockSize)[i%aes.BlockSize]
+	}
+	s0 := counterBlock(0)
+	tag = make([]byte, tagSize)
+	for i := range tag {
+		tag[i] = x[i] ^ s0[i]
+	}
+	return ciphertext, tag
+}
+
+// RFC 3610 section 8, packet vectors #1 to #3.
+var rfc3610Vectors = []struct {
+	name, nonce, aad, plaintext, ciphertext, tag string
+}{
+	{
+		"packet 1", "00000003020100a0a1a2a3a4a5", "0001020304050607",
+		"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		"588c979a61c663d2f066d0c2c0f989806d5f6b61dac384", "17e8d12cfdf926e0",
+	},
+	{
+		"packet 2", "00000004030201a0a1a2a3a4a5", "0001020304050607",
+		"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3b", "a091d56e10400916",
+	},
+	{
+		"packet 3", "00000005040302a0a1a2a3a4a5", "0001020304050607",
+		"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		"51b1e5f44a197d1da46b0f8e2d282ae871e838bb64da859657", "4adaa76fbd9fb0c5",
+	},
+}
+
+func TestCCMOpenRFC3610(t *testing.T) {
+	key := mustHex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf")
+	for _, v := range rfc3610Vectors {
+		t.Run(v.name, func(t *testing.T) {
+			nonce, aad := mustHex(t, v.nonce), mustHex(t, v.aad)
+			ciphertext, tag := mustHex(t, v.ciphertext), mustHex(t, v.tag)
+			plaintext, err := ccmOpen(key, nonce, ciphertext, tag, aad)
+			if err != nil {
+				t.Fatalf("ccmOpen: %v", err)
+			}
+			if want := mustHex(t, v.plaintext); !bytes.Equal(plaintext, want) {
+				t.Errorf("plaintext = %x, want %x", plaintext, want)
+			}
+
+			// The test helper must agree with the vectors too.
+			c, g := ccmSeal(t, key, nonce, mustHex(t, v.plaintext), aad, len(tag))
+			if !bytes.Equal(c, ciphertext) || !bytes.Equal(g, tag) {
+				t.Errorf("ccmSeal = %x %x, want %x %x", c, g, ciphertext, tag)
+			}
+
+			tampered := append([]byte{}, ciphertext...)
+			tampered[0] ^= 1
+			if _, err := ccmOpen(key, nonce, tampered, tag, aad); !errors.Is(err, errCCMAuth) {
+				t.Errorf("tampered ciphertext: err = %v, want errCCMAuth", err)
+			}
+			if _, err := ccmOpen(key, nonce, ciphertext, tag, nil); !errors.Is(err, errCCMAuth) {
+				t.Errorf("missing additional data: err = %v, want errCCMAuth", err)
+			}
+		})
+	}
+}
+
+func TestCCMOpenSizes(t *testing.T) {
+	key := make([]byte, 16)
+	for _, c := range []struct {
+		name       string
+		nonce, tag int
+	}{
+		{"short nonce", 6, 4},
+		{"long nonce", 14, 4},
+		{"short tag", 12, 2},
+		{"odd tag", 12, 5},
+	} {
+		if _, err := ccmOpen(key, make([]byte, c.nonce), nil, make([]byte, c.tag), nil); err == nil || errors.Is(err, errCCMAuth) {
+			t.Errorf("%s: err = %v, want a size error", c.name, err)
+		}
+	}
+}
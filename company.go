@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// companyIDsCSV holds "id,name" rows of the Bluetooth SIG's company
+// identifiers. "go generate" replaces it with the SIG's current list, and
+// decode.company_ids_file adds identifiers assigned since the build. The
+// checked-in copy holds the low identifiers and those of the vendors with
+// decoders only, until it is regenerated with network access.
+//
+//go:generate go run gen_company_ids.go
+//go:embed company_ids.csv
+var companyIDsCSV []byte
+
+// companyNames maps Bluetooth SIG company identifiers to vendor names.
+// It is only modified by loadCompanyIDs during startup.
+var companyNames = func() map[uint16]string {
+	m := make(map[uint16]string)
+	if err := parseCompanyIDs(bytes.NewReader(companyIDsCSV), m); err != nil {
+		panic("company_ids.csv: " + err.Error())
+	}
+	return m
+}()
+
+// companyName returns the vendor name of a company identifier, or "" if
+// it is unknown.
+func companyName(id uint16) string {
+	return companyNames[id]
+}
+
+// deviceVendor returns the first of the vendors of adv, or "" if none
+// is known.
+func deviceVendor(adv Advertisement) string {
+	if v := advertisementVendors(adv); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// advertisementVendors returns the vendors named by the payloads of adv.
+// A vendor set by a decoder that recognised a payload comes first and
+// replaces the company identifier's name, since some devices advertise
+// under another company's identifier or fill it with readings.
+func advertisementVendors(adv Advertisement) []string {
+	var vendors []string
+	decoded := make(map[uint16]bool)
+	for _, d := range adv.Decoded {
+		if d.ServiceUUID == "" {
+			decoded[d.CompanyID] = true
+		}
+		if d.Vendor != "" {
+			vendors = appendUnique(vendors, d.Vendor)
+		}
+	}
+	for _, m := range adv.ManufacturerData {
+		if v := companyName(m.CompanyID); v != "" && !decoded[m.CompanyID] {
+			vendors = appendUnique(vendors, v)
+		}
+	}
+	return vendors
+}
+
+// loadCompanyIDs adds the company identifiers in file, if set, to the
+// built-in ones, replacing those with the same identifier.
+func loadCompanyIDs(file string) error {
+	if file == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := parseCompanyIDs(f, companyNames); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// parseCompanyIDs reads CSV rows of a decimal or 0x-prefixed hexadecimal
+// identifier and a name into m. A header row starting with "id" is
+// skipped.
+func parseCompanyIDs(r io.Reader, m map[uint16]string) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if first && strings.EqualFold(row[0], "id") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(row[0]), 0, 16)
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		m[uint16(id)] = strings.TrimSpace(row[1])
+	}
+}
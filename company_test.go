@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCompanyName(t *testing.T) {
+	for id, want := range map[uint16]string{
+		0x0000: "Ericsson AB",
+		0x004C: "Apple, Inc.",
+		0x0059: "Nordic Semiconductor ASA",
+		0x02E1: "Victron Energy BV",
+		0x038F: "Xiaomi Inc.",
+		0x0499: "Ruuvi Innovations Ltd.",
+		0x0969: "Woan Technology (Shenzhen) Co., Ltd.",
+		0xFFFF: "",
+	} {
+		if got := companyName(id); got != want {
+			t.Errorf("companyName(%#04x) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+// TestCompanyIDsCSV checks that the embedded table is what
+// gen_company_ids.go writes: a header, then unique identifiers in order.
+func TestCompanyIDsCSV(t *testing.T) {
+	rows, err := csv.NewReader(bytes.NewReader(companyIDsCSV)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 || rows[0][0] != "id" || rows[0][1] != "name" {
+		t.Fatalf("header %v", rows[:1])
+	}
+	prev := -1
+	for _, row := range rows[1:] {
+		id, err := strconv.ParseUint(row[0], 0, 16)
+		if err != nil || len(row[0]) != 6 || row[1] == "" {
+			t.Errorf("row %v", row)
+			continue
+		}
+		if int(id) <= prev {
+			t.Errorf("%s after %#04x", row[0], prev)
+		}
+		prev = int(id)
+	}
+}
+
+func TestLoadCompanyIDs(t *testing.T) {
+	old := companyNames
+	t.Cleanup(func() { companyNames = old })
+	companyNames = map[uint16]string{0x0499: "Ruuvi Innovations Ltd.", 0x0059: "Nordic Semiconductor ASA"}
+
+	file := filepath.Join(t.TempDir(), "companies.csv")
+	if err := os.WriteFile(file, []byte("id,name\n0x0F2C,\"Example, Inc.\"\n1113,Ruuvi\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCompanyIDs(file); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uint16]string{0x0F2C: "Example, Inc.", 0x0459: "Ruuvi", 0x0499: "Ruuvi Innovations Ltd.", 0x0059: "Nordic Semiconductor ASA"} {
+		if got := companyName(id); got != want {
+			t.Errorf("companyName(%#04x) = %q, want %q", id, got, want)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("id,name\nRuuvi,0x0499\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCompanyIDs(file); err == nil {
+		t.Error("loaded a file with an invalid identifier")
+	}
+}
@@ -1,8 +1,631 @@
 package main
 
-// influxToken
-var influxToken = "loJwIREFDqGQcO6ummRk5lRkdbHA1oulukQCeT0oM1wF53AeI50JCYV10LTXgD4mlzIymoFAaASYNJM0Mkl6GA=="
-var redisAddr = "redis.local:6379"
-var influxURL = "http://influx.local:8086"
-var influxOrg = "home"
-var influxBucket = "radio"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased flag name to form the
+// environment variable that overrides a setting, e.g. redis-addr is
+// read from GOTOOTH_REDIS_ADDR.
+const envPrefix = "GOTOOTH_"
+
+// defaultConfigPaths are tried in order when no config file is given
+// with -config or GOTOOTH_CONFIG. A missing default file is not an error.
+var defaultConfigPaths = []string{
+	"gotooth.json",
+	"gotooth.yaml",
+	"gotooth.toml",
+	"/etc/gotooth/gotooth.json",
+	"/etc/gotooth/gotooth.yaml",
+	"/etc/gotooth/gotooth.toml",
+}
+
+// Config is the complete runtime configuration of gotooth.
+//
+// Values are resolved in increasing order of precedence: built-in
+// defaults, the config file, GOTOOTH_* environment variables and finally
+// command-line flags. The config file is JSON, YAML or TOML; all three use
+// the json tags below.
+type Config struct {
+	Redis     RedisConfig     `json:"redis"`
+	Influx    InfluxConfig    `json:"influx"`
+	Bluetooth BluetoothConfig `json:"bluetooth"`
+	Scan      ScanConfig      `json:"scan"`
+	Registry  RegistryConfig  `json:"registry"`
+	Sinks     SinksConfig     `json:"sinks"`
+	Metrics   MetricsConfig   `json:"metrics"`
+	Spool     SpoolConfig     `json:"spool"`
+	Log       LogConfig       `json:"log"`
+	Pipeline  PipelineConfig  `json:"pipeline"`
+	Connect   ConnectConfig   `json:"connect"`
+	Decode    DecodeConfig    `json:"decode"`
+	Beacons   BeaconConfig    `json:"beacons"`
+
+	// ShutdownTimeout bounds the time from SIGINT or SIGTERM until the
+	// sinks and the registry have been flushed and closed.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// dumpConfig prints the effective config with secrets redacted and
+	// exits.
+	dumpConfig bool
+}
+
+type RedisConfig struct {
+	Addr string `json:"addr"`
+	DB   int    `json:"db"`
+
+	// Username and Password authenticate with a Redis 6 ACL user. With
+	// only a password set the legacy AUTH command is used.
+	Username string    `json:"username"`
+	Password Secret    `json:"password"`
+	TLS      TLSConfig `json:"tls"`
+
+	// Failed commands are retried up to MaxRetries times, backing off
+	// exponentially from RetryInterval up to MaxRetryInterval. Registry
+	// updates run on the scan path, so keep retries short and leave
+	// longer outages to the breaker and the spool.
+	MaxRetries       int      `json:"max_retries"`
+	RetryInterval    Duration `json:"retry_interval"`
+	MaxRetryInterval Duration `json:"max_retry_interval"`
+
+	// Timeout bounds dialing and each read and write.
+	Timeout Duration `json:"timeout"`
+
+	// Breaker stops calling Redis after repeated failures. Registry
+	// updates are spooled meanwhile.
+	Breaker BreakerConfig `json:"breaker"`
+}
+
+type InfluxConfig struct {
+	URL    string `json:"url"`
+	Token  Secret `json:"token"`
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+
+	// TLS applies to https URLs.
+	TLS TLSConfig `json:"tls"`
+
+	// BatchSize points are sent per request, or fewer once FlushInterval
+	// has passed.
+	BatchSize     uint     `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+
+	// BufferSize bounds the points waiting to be batched. Points beyond
+	// it are spooled, or dropped without a spool, rather than blocking the
+	// scanner.
+	BufferSize int `json:"buffer_size"`
+
+	// Failed batches are retried up to MaxRetries times, backing off
+	// exponentially from RetryInterval up to MaxRetryInterval. At most
+	// RetryBufferLimit points are kept for retrying. With spool.dir set,
+	// MaxRetries is ignored: a failed batch is spooled on its first
+	// failure and retried by the spool's replay instead.
+	MaxRetries       uint     `json:"max_retries"`
+	RetryInterval    Duration `json:"retry_interval"`
+	MaxRetryInterval Duration `json:"max_retry_interval"`
+	RetryBufferLimit uint     `json:"retry_buffer_limit"`
+
+	// Timeout bounds each HTTP request.
+	Timeout Duration `json:"timeout"`
+
+	// Breaker stops sending points after repeated write failures. Points
+	// go straight to the spool, or are dropped without one, until the
+	// server answers a ping again.
+	Breaker BreakerConfig `json:"breaker"`
+}
+
+type BluetoothConfig struct {
+	// Adapter selects the HCI adapter by id (e.g. "hci1"). Empty means
+	// the platform default adapter.
+	Adapter string `json:"adapter"`
+}
+
+type ScanConfig struct {
+	// Backend is one of "bluetooth", "simulator" or "replay".
+	Backend string `json:"backend"`
+
+	// Record appends every advertisement to this file as JSON lines,
+	// ready to be played back by the replay backend.
+	Record string `json:"record"`
+
+	// A failed scan is restarted, re-enabling the adapter first, after a
+	// delay growing exponentially from RestartInterval up to
+	// MaxRestartInterval.
+	RestartInterval    Duration `json:"restart_interval"`
+	MaxRestartInterval Duration `json:"max_restart_interval"`
+
+	Simulator SimulatorConfig `json:"simulator"`
+	Replay    ReplayConfig    `json:"replay"`
+}
+
+type RegistryConfig struct {
+	// Backend is "redis" or "memory". The memory registry forgets every
+	// device on restart.
+	Backend string `json:"backend"`
+
+	// KeyPrefix namespaces the Redis keys of the registry.
+	KeyPrefix string `json:"key_prefix"`
+}
+
+type SinksConfig struct {
+	// Enabled lists the sinks every event is written to: influx, stdout
+	// (JSON lines), file (JSON lines) and none.
+	Enabled []string `json:"enabled"`
+
+	// File is the path written by the file sink.
+	File string `json:"file"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+
+			MaxRetries:       1,
+			RetryInterval:    Duration(100 * time.Millisecond),
+			MaxRetryInterval: Duration(time.Second),
+			Timeout:          Duration(time.Second),
+			Breaker:          BreakerConfig{Failures: 3, Cooldown: Duration(30 * time.Second)},
+		},
+		Influx: InfluxConfig{
+			URL:    "http://localhost:8086",
+			Org:    "home",
+			Bucket: "radio",
+
+			BatchSize:        500,
+			FlushInterval:    Duration(time.Second),
+			BufferSize:       10000,
+			MaxRetries:       5,
+			RetryInterval:    Duration(5 * time.Second),
+			MaxRetryInterval: Duration(2 * time.Minute),
+			RetryBufferLimit: 50000,
+			Timeout:          Duration(10 * time.Second),
+			Breaker:          BreakerConfig{Failures: 3, Cooldown: Duration(30 * time.Second)},
+		},
+		Scan: ScanConfig{
+			Backend:            "bluetooth",
+			RestartInterval:    Duration(time.Second),
+			MaxRestartInterval: Duration(time.Minute),
+			Replay:             ReplayConfig{Speed: 1},
+		},
+		Registry: RegistryConfig{
+			Backend:   "redis",
+			KeyPrefix: "gotooth",
+		},
+		Sinks: SinksConfig{
+			Enabled: []string{"influx"},
+		},
+		Spool: SpoolConfig{
+			MaxSegmentBytes: 4 << 20,
+			MaxBytes:        256 << 20,
+			MaxAge:          Duration(7 * 24 * time.Hour),
+			ReplayInterval:  Duration(30 * time.Second),
+		},
+		Pipeline: PipelineConfig{
+			Workers:    4,
+			QueueSize:  1024,
+			DropPolicy: "drop-oldest",
+		},
+		Connect: ConnectConfig{
+			MaxConnections:  2,
+			Timeout:         Duration(20 * time.Second),
+			QueueSize:       256,
+			Reinterrogate:   Duration(7 * 24 * time.Hour),
+			BatteryInterval: Duration(6 * time.Hour),
+			DefaultAction:   "connect",
+
+			RetryInterval:    Duration(time.Minute),
+			MaxRetryInterval: Duration(time.Hour),
+			QuarantineAfter:  5,
+			Quarantine:       Duration(24 * time.Hour),
+		},
+		Decode: DecodeConfig{
+			DedupeWindow: Duration(time.Minute),
+		},
+		Beacons: BeaconConfig{
+			ExitTimeout: Duration(30 * time.Second),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		ShutdownTimeout: Duration(15 * time.Second),
+	}
+}
+
+// setting is a single option that can be overridden from the environment
+// and the command line.
+type setting struct {
+	name  string
+	usage string
+	value flag.Value
+}
+
+// settings lists every overridable option bound to the fields of c.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"redis-addr", "Redis server `address` (host:port)", (*stringValue)(&c.Redis.Addr)},
+		{"redis-db", "Redis database `number`", (*intValue)(&c.Redis.DB)},
+		{"influx-url", "InfluxDB server base `URL`", (*stringValue)(&c.Influx.URL)},
+		{"redis-username", "Redis ACL `user`", (*stringValue)(&c.Redis.Username)},
+		{"redis-password", "Redis password secret `ref`erence", &c.Redis.Password},
+		{"redis-tls", "connect to Redis over TLS", (*boolValue)(&c.Redis.TLS.Enabled)},
+		{"redis-tls-ca", "CA certificate `file` for Redis TLS", (*stringValue)(&c.Redis.TLS.CAFile)},
+		{"influx-token", "InfluxDB token secret `ref`erence", &c.Influx.Token},
+		{"influx-tls-ca", "CA certificate `file` for InfluxDB TLS", (*stringValue)(&c.Influx.TLS.CAFile)},
+		{"influx-org", "InfluxDB `organization`", (*stringValue)(&c.Influx.Org)},
+		{"influx-bucket", "InfluxDB `bucket` for radio measurements", (*stringValue)(&c.Influx.Bucket)},
+		{"adapter", "Bluetooth adapter `id`, e.g. hci0 (Linux only)", (*stringValue)(&c.Bluetooth.Adapter)},
+		{"scan-backend", "advertisement source: bluetooth, simulator or replay", (*stringValue)(&c.Scan.Backend)},
+		{"registry", "device registry backend: redis or memory", (*stringValue)(&c.Registry.Backend)},
+		{"sinks", "comma-separated `list` of sinks: influx, stdout, file, none", (*listValue)(&c.Sinks.Enabled)},
+		{"sink-file", "`path` written by the file sink", (*stringValue)(&c.Sinks.File)},
+		{"influx-batch-size", "InfluxDB points per write `request`", (*uintValue)(&c.Influx.BatchSize)},
+		{"influx-flush-interval", "maximum `delay` before a partial InfluxDB batch is sent", &c.Influx.FlushInterval},
+		{"metrics-listen", "serve internal metrics at /debug/vars on `address`", (*stringValue)(&c.Metrics.Listen)},
+		{"record", "append every advertisement to `file` as JSON lines", (*stringValue)(&c.Scan.Record)},
+		{"replay", "replay advertisements recorded in `file` (with -scan-backend replay)", (*stringValue)(&c.Scan.Replay.File)},
+		{"workers", "`number` of advertisement processing workers", (*intValue)(&c.Pipeline.Workers)},
+		{"queue-size", "maximum queued `advertisements`", (*intValue)(&c.Pipeline.QueueSize)},
+		{"drop-policy", "on a full queue: drop-newest, drop-oldest or block", (*stringValue)(&c.Pipeline.DropPolicy)},
+		{"max-connections", "`number` of devices interrogated at once", (*intValue)(&c.Connect.MaxConnections)},
+		{"connect-timeout", "maximum `duration` of a connection attempt", &c.Connect.Timeout},
+		{"pause-scan", "stop scanning while connecting to a device", (*boolValue)(&c.Connect.PauseScan)},
+		{"passive", "never connect to devices, only listen to advertisements", (*boolValue)(&c.Connect.Passive)},
+		{"connect-default", "`action` for devices no connection rule matches: connect or skip", (*stringValue)(&c.Connect.DefaultAction)},
+		{"company-ids-file", "CSV `file` of Bluetooth SIG company identifiers extending the built-in vendor names", (*stringValue)(&c.Decode.CompanyIDsFile)},
+		{"reinterrogate", "interrogate devices again when their GATT profile is older than `duration`, 0 for never", &c.Connect.Reinterrogate},
+		{"battery-interval", "read the battery level of known devices every `duration`, 0 for on interrogation only", &c.Connect.BatteryInterval},
+		{"log-level", "log `level`: trace, debug, info, warn or error", (*stringValue)(&c.Log.Level)},
+		{"log-format", "log `format`: text or json", (*stringValue)(&c.Log.Format)},
+		{"shutdown-timeout", "maximum `duration` of a graceful shutdown", &c.ShutdownTimeout},
+		{"spool-dir", "spool writes to `directory` while InfluxDB or Redis is unreachable", (*stringValue)(&c.Spool.Dir)},
+	}
+}
+
+// flagSet returns a FlagSet bound to the settings of c. The config file
+// path is stored in path.
+//
+// Secrets accept references only (see Secret), so a flag never carries a
+// credential.
+func (c *Config) flagSet(path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gotooth", flag.ContinueOnError)
+	fs.StringVar(path, "config", "", "`path` to the JSON, YAML or TOML config file (env "+envPrefix+"CONFIG)")
+	fs.BoolVar(&c.dumpConfig, "dump-config", false, "print the effective config with secrets redacted and exit")
+	for _, s := range c.settings() {
+		fs.Var(s.value, s.name, s.usage+" (env "+envName(s.name)+")")
+	}
+	return fs
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig resolves the configuration from defaults, the config file,
+// the environment and args, and validates the result.
+func loadConfig(args []string) (*Config, error) {
+	// The first pass only finds the config file; flags are applied again
+	// once the file and the environment have been read so they win.
+	var path string
+	if err := defaultConfig().flagSet(&path).Parse(args); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.loadFile(path); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.flagSet(&path).Parse(args); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads path into c. An empty path tries defaultConfigPaths.
+// The extension picks the format: .yaml or .yml is YAML, .toml is TOML
+// and anything else JSON.
+func (c *Config) loadFile(path string) error {
+	if path == "" {
+		for _, p := range defaultConfigPaths {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return nil
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if b, err = configJSON(strings.ToLower(filepath.Ext(path)), b); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// configJSON converts a YAML or TOML config file to JSON, so that every
+// format is decoded through the same json tags, Duration and Secret
+// unmarshalers and unknown-key check. Other files are returned as is.
+func configJSON(ext string, b []byte) ([]byte, error) {
+	var v map[string]interface{}
+	switch ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	default:
+		return b, nil
+	}
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+func (c *Config) loadEnv() error {
+	for _, s := range c.settings() {
+		name := envName(s.name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		var err error
+		if secret, ok := s.value.(*Secret); ok {
+			err = secret.setFromEnv(name, v)
+		} else {
+			err = s.value.Set(v)
+		}
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	switch c.Scan.Backend {
+	case "bluetooth":
+	case "simulator":
+		if err := c.Scan.Simulator.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	case "replay":
+		if c.Scan.Replay.File == "" {
+			errs = append(errs, errors.New("scan.replay.file is required by the replay backend"))
+		}
+		if c.Scan.Replay.Speed < 0 {
+			errs = append(errs, errors.New("scan.replay.speed must not be negative"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("scan.backend must be bluetooth, simulator or replay, got %q", c.Scan.Backend))
+	}
+	if c.Scan.RestartInterval <= 0 || c.Scan.MaxRestartInterval < c.Scan.RestartInterval {
+		errs = append(errs, errors.New("scan.restart_interval must be positive and at most scan.max_restart_interval"))
+	}
+	switch c.Registry.Backend {
+	case "redis":
+		if c.Registry.KeyPrefix == "" {
+			errs = append(errs, errors.New("registry.key_prefix is required by the redis registry"))
+		}
+		errs = append(errs, c.Redis.validate()...)
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("registry.backend must be redis or memory, got %q", c.Registry.Backend))
+	}
+	for _, name := range c.Sinks.Enabled {
+		switch name {
+		case "influx":
+			errs = append(errs, c.Influx.validate()...)
+		case "file":
+			if c.Sinks.File == "" {
+				errs = append(errs, errors.New("sinks.file is required by the file sink"))
+			}
+		case "stdout", "none":
+		default:
+			errs = append(errs, fmt.Errorf("sinks.enabled: unknown sink %q", name))
+		}
+	}
+	if err := c.Spool.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Pipeline.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Connect.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Decode.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Beacons.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Log.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (c RedisConfig) validate() []error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("redis.addr is required"))
+	}
+	if c.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis.db must not be negative, got %d", c.DB))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, errors.New("redis.max_retries must not be negative"))
+	}
+	if c.Timeout < Duration(time.Millisecond) {
+		errs = append(errs, errors.New("redis.timeout must be at least 1ms"))
+	}
+	if err := c.Breaker.validate("redis"); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.TLS.validate("redis"); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (c InfluxConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("influx.url must be an http(s) URL, got %q", c.URL))
+	}
+	if !c.Token.IsSet() {
+		errs = append(errs, errors.New("influx.token is required"))
+	}
+	if c.Org == "" {
+		errs = append(errs, errors.New("influx.org is required"))
+	}
+	if c.Bucket == "" {
+		errs = append(errs, errors.New("influx.bucket is required"))
+	}
+	if c.BatchSize == 0 {
+		errs = append(errs, errors.New("influx.batch_size must be positive"))
+	}
+	if c.FlushInterval < Duration(time.Millisecond) {
+		errs = append(errs, errors.New("influx.flush_interval must be at least 1ms"))
+	}
+	if c.BufferSize <= 0 {
+		errs = append(errs, errors.New("influx.buffer_size must be positive"))
+	}
+	if c.Timeout < Duration(time.Second) {
+		errs = append(errs, errors.New("influx.timeout must be at least 1s"))
+	}
+	if err := c.Breaker.validate("influx"); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.TLS.validate("influx"); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+// listValue is a comma-separated list of strings.
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			*v = append(*v, e)
+		}
+	}
+	return nil
+}
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+type uintValue uint
+
+func (v *uintValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 0)
+	if err != nil {
+		return err
+	}
+	*v = uintValue(n)
+	return nil
+}
+func (v *uintValue) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// Duration is a time.Duration that reads and writes as a string such as
+// "1m30s" in the config file.
+type Duration time.Duration
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+func (d *Duration) String() string { return time.Duration(*d).String() }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"gotooth.json": `{"redis": {"addr": "redis:6379"}, "influx": {"token": "env:INFLUX_TOKEN"}, ` +
+			`"sinks": {"enabled": ["influx", "stdout"]}, "shutdown_timeout": "30s"}`,
+		"gotooth.yaml": "redis:\n  addr: redis:6379\ninflux:\n  token: env:INFLUX_TOKEN\n" +
+			"sinks:\n  enabled: [influx, stdout]\nshutdown_timeout: 30s\n",
+		"gotooth.yml": "redis: {addr: \"redis:6379\"}\ninflux: {token: \"env:INFLUX_TOKEN\"}\n" +
+			"sinks:\n  enabled:\n    - influx\n    - stdout\nshutdown_timeout: 30s\n",
+		"gotooth.TOML": "shutdown_timeout = \"30s\"\n[redis]\naddr = \"redis:6379\"\n" +
+			"[influx]\ntoken = \"env:INFLUX_TOKEN\"\n[sinks]\nenabled = [\"influx\", \"stdout\"]\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c := defaultConfig()
+		if err := c.loadFile(path); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if c.Redis.Addr != "redis:6379" || c.Redis.DB != defaultConfig().Redis.DB {
+			t.Errorf("%s: redis %+v", name, c.Redis)
+		}
+		if c.Influx.Token.String() != "env:INFLUX_TOKEN" {
+			t.Errorf("%s: influx.token %q", name, c.Influx.Token.String())
+		}
+		if strings.Join(c.Sinks.Enabled, ",") != "influx,stdout" {
+			t.Errorf("%s: sinks.enabled %v", name, c.Sinks.Enabled)
+		}
+		if c.ShutdownTimeout != Duration(30*time.Second) {
+			t.Errorf("%s: shutdown_timeout %v", name, c.ShutdownTimeout)
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"unknown.json":  `{"redis": {"adress": "redis:6379"}}`,
+		"unknown.yaml":  "redis:\n  adress: redis:6379\n",
+		"unknown.toml":  "[redis]\nadress = \"redis:6379\"\n",
+		"literal.yaml":  "influx:\n  token: hunter2\n",
+		"literal.toml":  "[influx]\ntoken = \"hunter2\"\n",
+		"duration.yaml": "shutdown_timeout: 30\n",
+		"syntax.yaml":   "redis: [addr\n",
+		"syntax.toml":   "[redis\naddr = 1\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := defaultConfig().loadFile(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestLoadFileEmpty(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"empty.yaml", "empty.toml"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c := defaultConfig()
+		if err := c.loadFile(path); err != nil || c.Redis != defaultConfig().Redis {
+			t.Errorf("%s: %+v, %v", name, c.Redis, err)
+		}
+	}
+}
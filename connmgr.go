@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConnectConfig configures the interrogation of newly found devices.
+type ConnectConfig struct {
+	// MaxConnections is the number of devices interrogated at once.
+	MaxConnections int `json:"max_connections"`
+
+	// Timeout bounds each connection attempt, including the
+	// interrogation.
+	Timeout Duration `json:"timeout"`
+
+	// QueueSize bounds the devices waiting to be interrogated. Devices
+	// found while the queue is full are not interrogated.
+	QueueSize int `json:"queue_size"`
+
+	// PauseScan stops scanning while connecting, for controllers that
+	// cannot do both at once. Connections are then made one at a time.
+	PauseScan bool `json:"pause_scan"`
+
+	// Reinterrogate is how old a device's GATT profile may get before the
+	// device is interrogated again when next seen. Zero never
+	// re-interrogates.
+	Reinterrogate Duration `json:"reinterrogate"`
+
+	// BatteryInterval is how often the battery level of a device whose
+	// profile has a Battery service is read between interrogations, when
+	// the device is seen. Zero reads it on interrogation only.
+	BatteryInterval Duration `json:"battery_interval"`
+
+	// Passive never connects to any device, whatever the rules say.
+	Passive bool `json:"passive"`
+
+	// Rules decide which devices are connected to. The first matching
+	// rule wins; DefaultAction, "connect" or "skip", applies when none
+	// does.
+	Rules         []ConnectRule `json:"rules"`
+	DefaultAction string        `json:"default_action"`
+
+	// A device whose connection attempt fails is retried when next seen,
+	// after a delay growing exponentially from RetryInterval up to
+	// MaxRetryInterval.
+	RetryInterval    Duration `json:"retry_interval"`
+	MaxRetryInterval Duration `json:"max_retry_interval"`
+
+	// QuarantineAfter failures in a row quarantine a device: it is not
+	// tried again for Quarantine, and then only once before the next
+	// quarantine unless that attempt succeeds. Zero never quarantines.
+	QuarantineAfter int      `json:"quarantine_after"`
+	Quarantine      Duration `json:"quarantine"`
+}
+
+func (c ConnectConfig) validate() error {
+	var errs []error
+	if c.MaxConnections < 1 {
+		errs = append(errs, errors.New("connect.max_connections must be at least 1"))
+	}
+	if c.Timeout < Duration(time.Second) {
+		errs = append(errs, errors.New("connect.timeout must be at least 1s"))
+	}
+	if c.QueueSize < 1 {
+		errs = append(errs, errors.New("connect.queue_size must be at least 1"))
+	}
+	if c.Reinterrogate != 0 && c.Reinterrogate < Duration(time.Minute) {
+		errs = append(errs, errors.New("connect.reinterrogate must be 0 or at least 1m"))
+	}
+	if c.BatteryInterval != 0 && c.BatteryInterval < Duration(time.Minute) {
+		errs = append(errs, errors.New("connect.battery_interval must be 0 or at least 1m"))
+	}
+	if c.RetryInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("connect.retry_interval must be at least 1s"))
+	}
+	if c.MaxRetryInterval < c.RetryInterval {
+		errs = append(errs, errors.New("connect.max_retry_interval must be at least connect.retry_interval"))
+	}
+	if c.QuarantineAfter < 0 {
+		errs = append(errs, errors.New("connect.quarantine_after must not be negative"))
+	}
+	if c.QuarantineAfter > 0 && c.Quarantine < c.MaxRetryInterval {
+		errs = append(errs, errors.New("connect.quarantine must be at least connect.max_retry_interval"))
+	}
+	if _, err := newConnectPolicy(c); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// connManager interrogates newly found devices in the background. Each
+// address is queued at most once at a time.
+type connManager struct {
+	config ConnectConfig
+	policy *connectPolicy
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// pauses carries requests to stop scanning to the scan loop when
+	// config.PauseScan is set.
+	pauses chan scanPause
+
+	mu      sync.Mutex
+	pending chan connRequest
+	queued  map[string]bool
+	closed  bool
+	active  int
+	wg      sync.WaitGroup
+
+	// states tracks the devices queued during this run.
+	states map[string]*deviceConnState
+}
+
+// connRequest is a queued connection to device, which reads its battery
+// level only if battery is set and interrogates it otherwise.
+type connRequest struct {
+	device  Advertisement
+	battery bool
+}
+
+// scanPause asks the scan loop to stop scanning. The loop closes stopped
+// once the scan has returned and waits for resume before scanning again.
+type scanPause struct {
+	stopped chan struct{}
+	resume  chan struct{}
+}
+
+func newConnManager(ctx context.Context, c ConnectConfig) (*connManager, error) {
+	policy, err := newConnectPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range c.Rules {
+		for _, s := range r.ServiceUUIDs {
+			// Checked by newConnectPolicy.
+			u, _ := parseUUID(s)
+			watchServiceUUID(u)
+		}
+	}
+	m := &connManager{
+		config:  c,
+		policy:  policy,
+		pauses:  make(chan scanPause),
+		pending: make(chan connRequest, c.QueueSize),
+		queued:  make(map[string]bool),
+		states:  make(map[string]*deviceConnState),
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	workers := c.MaxConnections
+	if c.PauseScan {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	metrics.Set("connect_queue_depth", expvar.Func(func() interface{} { return len(m.pending) }))
+	metrics.Set("connect_active", expvar.Func(func() interface{} {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.active
+	}))
+	metrics.Set("connect_unreachable", expvar.Func(m.unreachable))
+	return m, nil
+}
+
+// Enqueue queues device for interrogation unless the connection policy
+// says otherwise, it is already queued or the queue is full.
+func (m *connManager) Enqueue(device Advertisement) {
+	m.enqueue(connRequest{device: device})
+}
+
+func (m *connManager) enqueue(req connRequest) {
+	device := req.device
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.state(device.Address)
+
+	connect, rule := m.policy.decide(device)
+	l := gattLog.WithFields(advFields(device)).WithField("rule", rule)
+	if !connect {
+		metrics.Add("connect_skipped", 1)
+		l.Info("connection policy: not connecting")
+		return
+	}
+	l.Info("connection policy: connecting")
+
+	if m.queued[device.Address] {
+		return
+	}
+	select {
+	case m.pending <- req:
+		m.queued[device.Address] = true
+	default:
+		metrics.Add("connect_dropped", 1)
+		l.Warn("connection queue full, not interrogating device")
+	}
+}
+
+// Revisit is called for the advertisements of known devices with their
+// record. It queues the device again when a retry is due, when it was
+// found but not interrogated by an earlier run, or when its profile is
+// older than config.Reinterrogate. Otherwise it queues a read of the
+// battery level once config.BatteryInterval has passed since the last.
+func (m *connManager) Revisit(device Advertisement, rec *DeviceRecord) {
+	now := time.Now()
+	interrogatedAt := rec.InterrogatedAt
+	reinterrogate := time.Duration(m.config.Reinterrogate)
+	batteryInterval := time.Duration(m.config.BatteryInterval)
+	hasBattery := rec.Info != nil && rec.Info.BatteryLevel != nil
+	var reason string
+	var battery bool
+	m.mu.Lock()
+	s, ok := m.states[device.Address]
+	switch {
+	case !ok && interrogatedAt.IsZero():
+		reason = "not interrogated yet"
+		s = m.state(device.Address)
+	case ok && !s.RetryAt.IsZero():
+		if now.Before(s.RetryAt) {
+			m.mu.Unlock()
+			return
+		}
+		reason = "retry"
+		metrics.Add("connect_retries", 1)
+		// Until the attempt reports back, in case it is never made.
+		s.RetryAt = now.Add(s.backoff.next())
+	case reinterrogate != 0 && !interrogatedAt.IsZero() && now.Sub(interrogatedAt) >= reinterrogate:
+		if ok && now.Sub(s.revisited) < reinterrogate {
+			m.mu.Unlock()
+			return
+		}
+		reason = "profile outdated"
+		s = m.state(device.Address)
+	case batteryInterval != 0 && hasBattery && now.Sub(interrogatedAt) >= batteryInterval:
+		if ok && now.Sub(s.batteryRead) < batteryInterval {
+			m.mu.Unlock()
+			return
+		}
+		reason, battery = "battery level due", true
+		s = m.state(device.Address)
+		s.batteryRead = now
+	default:
+		m.mu.Unlock()
+		return
+	}
+	s.revisited = now
+	m.mu.Unlock()
+
+	gattLog.WithFields(advFields(device)).WithField("reason", reason).Debug("revisiting device")
+	m.enqueue(connRequest{device: device, battery: battery})
+}
+
+func (m *connManager) work() {
+	defer m.wg.Done()
+	for req := range m.pending {
+		if m.ctx.Err() == nil {
+			m.attempt(req)
+		}
+		m.mu.Lock()
+		delete(m.queued, req.device.Address)
+		m.mu.Unlock()
+	}
+}
+
+// attempt connects to the device of req, interrogates it or reads its
+// battery level and disconnects again, all within the configured timeout,
+// and records the outcome.
+func (m *connManager) attempt(req connRequest) {
+	device := req.device
+	if m.config.PauseScan {
+		resume, ok := m.pauseScan()
+		if !ok {
+			return
+		}
+		defer close(resume)
+	}
+	m.mu.Lock()
+	m.active++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.mu.Unlock()
+	}()
+
+	l := gattLog.WithFields(advFields(device))
+	ctx, cancel := context.WithTimeout(m.ctx, time.Duration(m.config.Timeout))
+	defer cancel()
+	metrics.Add("connect_attempts", 1)
+	start := time.Now()
+	err := m.interrogateDevice(ctx, l, req)
+	switch {
+	case errors.Is(err, errNotConnectable):
+		l.WithError(err).Debug("not connecting")
+		return
+	case errors.Is(err, context.Canceled):
+		// Shutting down.
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		metrics.Add("connect_timeouts", 1)
+		l.Warn("connection attempt timed out")
+	case err != nil:
+		metrics.Add("connect_failures", 1)
+		l.WithError(err).Warn("connection attempt failed")
+	}
+	m.record(device.Address, start, err)
+}
+
+// interrogateDevice connects to the device of req, then interrogates it
+// and saves its profile, or writes its battery level.
+func (m *connManager) interrogateDevice(ctx context.Context, l *logrus.Entry, req connRequest) error {
+	p, err := scanner.Connect(ctx, req.device.Address)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := p.Disconnect(); err != nil {
+			l.WithError(err).Warn("disconnect failed")
+		}
+	}()
+	l.Info("connected")
+
+	if req.battery {
+		level, err := m.readBatteryLevel(ctx, p)
+		if err != nil {
+			if ctx.Err() == nil {
+				metrics.Add("battery_read_failures", 1)
+			}
+			return fmt.Errorf("read battery level: %w", err)
+		}
+		metrics.Add("battery_reads", 1)
+		l.WithField("battery_level", level).Info("battery level read")
+		writeBatteryLevel(time.Now(), p.Address(), level)
+		return nil
+	}
+
+	profile, err := m.interrogate(ctx, p)
+	if err != nil {
+		if ctx.Err() == nil {
+			metrics.Add("interrogation_failures", 1)
+		}
+		return fmt.Errorf("interrogate: %w", err)
+	}
+	metrics.Add("interrogations", 1)
+	m.saveProfile(profile)
+	return nil
+}
+
+// interrogate runs interrogate(p) until ctx is done. On timeout the
+// interrogation is left to fail once the device is disconnected.
+func (m *connManager) interrogate(ctx context.Context, p Peripheral) (*GATTProfile, error) {
+	type result struct {
+		profile *GATTProfile
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		profile, err := interrogate(p)
+		done <- result{profile, err}
+	}()
+	select {
+	case r := <-done:
+		return r.profile, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readBatteryLevel runs readBatteryLevel(p) until ctx is done, as
+// interrogate does.
+func (m *connManager) readBatteryLevel(ctx context.Context, p Peripheral) (uint8, error) {
+	type result struct {
+		level uint8
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		level, err := readBatteryLevel(p)
+		done <- result{level, err}
+	}()
+	select {
+	case r := <-done:
+		return r.level, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// saveProfile stores profile in the registry and logs how it differs
+// from the one stored before.
+func (m *connManager) saveProfile(profile *GATTProfile) {
+	l := gattLog.WithField("address", profile.Address)
+	prev, err := registry.Profile(ctx, profile.Address)
+	switch {
+	case errors.Is(err, ErrNoProfile):
+		l.WithField("services", len(profile.Services)).Info("GATT profile recorded")
+	case err != nil:
+		l.WithError(err).Warn("load previous GATT profile failed")
+	default:
+		if changes := diffGATTProfiles(prev, profile); len(changes) > 0 {
+			metrics.Add("gatt_profile_changes", 1)
+			l.WithField("changes", changes).WithField("previous", prev.Time).Info("GATT profile changed")
+		} else {
+			l.Debug("GATT profile unchanged")
+		}
+	}
+	if err := registry.SaveProfile(ctx, profile); err != nil {
+		l.WithError(err).Warn("save GATT profile failed")
+	}
+
+	info := profile.deviceInfo()
+	if info == nil {
+		return
+	}
+	l.WithFields(deviceInfoFields(info)).Info("device information")
+	if info.BatteryLevel != nil {
+		writeBatteryLevel(profile.Time, profile.Address, *info.BatteryLevel)
+	}
+}
+
+// writeBatteryLevel writes the battery level of address read at t.
+func writeBatteryLevel(t time.Time, address string, level uint8) {
+	writeEvent(sinkLog.WithField("address", address), BatteryLevel{
+		Time:    t,
+		Host:    hostname,
+		Address: address,
+		Level:   level,
+	})
+}
+
+// pauseScan stops the scan loop and returns the channel to close to
+// resume it. It returns false if the manager is closed first.
+func (m *connManager) pauseScan() (chan struct{}, bool) {
+	p := scanPause{stopped: make(chan struct{}), resume: make(chan struct{})}
+	select {
+	case m.pauses <- p:
+	case <-m.ctx.Done():
+		return nil, false
+	}
+	select {
+	case <-p.stopped:
+		return p.resume, true
+	case <-m.ctx.Done():
+		close(p.resume)
+		return nil, false
+	}
+}
+
+// Close aborts the running attempts, disconnecting their devices, and
+// drops the queue.
+func (m *connManager) Close() {
+	m.cancel()
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.pending)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
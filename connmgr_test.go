@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatteryLevelPolling(t *testing.T) {
+	oldScanner, oldRegistry, oldSink := scanner, registry, sink
+	t.Cleanup(func() { scanner, registry, sink = oldScanner, oldRegistry, oldSink })
+
+	const address = "C4:7C:8D:6A:1B:2E"
+	var out bytes.Buffer
+	registry = newMemoryRegistry()
+	sink = newJSONSink(&out, nil)
+	scanner = newSimulator(SimulatorConfig{Fleet: []SimGroupConfig{{
+		Count: 1, Address: address, Interval: Duration(time.Second),
+		GATT: []SimServiceConfig{{
+			UUID:            "180f",
+			Characteristics: []SimCharacteristicConfig{{UUID: "2a19", Value: hexBytes{57}}},
+		}},
+	}}})
+
+	c := defaultConfig().Connect
+	c.BatteryInterval = Duration(time.Hour)
+	m, err := newConnManager(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := uint8(60)
+	device := Advertisement{Address: address}
+	rec := &DeviceRecord{InterrogatedAt: time.Now().Add(-90 * time.Minute), Info: &DeviceInfo{BatteryLevel: &level}}
+	attempts := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if s, ok := m.states[address]; ok {
+			return s.Attempts
+		}
+		return 0
+	}
+
+	m.Revisit(device, rec)
+	deadline := time.Now().Add(5 * time.Second)
+	for attempts() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("battery level not read after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Not again before the interval has passed, nor for a device whose
+	// profile has no Battery service.
+	m.Revisit(device, rec)
+	m.Revisit(Advertisement{Address: "C4:7C:8D:6A:1B:2F"}, &DeviceRecord{InterrogatedAt: rec.InterrogatedAt, Info: &DeviceInfo{}})
+	time.Sleep(50 * time.Millisecond)
+	m.Close()
+
+	if n := attempts(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if len(m.states) != 1 {
+		t.Errorf("connected to %d devices, want 1", len(m.states))
+	}
+	if _, err := registry.Profile(ctx, address); !errors.Is(err, ErrNoProfile) {
+		t.Errorf("device interrogated: %v", err)
+	}
+	var ev jsonEvent
+	if err := json.Unmarshal(out.Bytes(), &ev); err != nil {
+		t.Fatalf("%s: %v", out.Bytes(), err)
+	}
+	if ev.Measurement != "battery" || ev.Tags["address"] != address || ev.Fields["level"] != 57.0 {
+		t.Errorf("wrote %s, want battery level 57", out.Bytes())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "time"
+
+// maxConnStates bounds connManager.states. Devices with random addresses
+// come and go, so the least recently attempted ones are forgotten.
+const maxConnStates = 10000
+
+// deviceConnState tracks the connection attempts to one device. It is
+// served as JSON in the connect_unreachable metric.
+type deviceConnState struct {
+	Attempts            int       `json:"attempts"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastDuration        Duration  `json:"last_duration"`
+
+	// RetryAt is when the device is next tried, zero if it need not be.
+	RetryAt time.Time `json:"retry_at"`
+
+	// QuarantinedUntil is set while failures keep exceeding
+	// connect.quarantine_after.
+	QuarantinedUntil time.Time `json:"quarantined_until"`
+
+	backoff     backoff
+	revisited   time.Time
+	batteryRead time.Time
+}
+
+// state returns the state of address, creating it if needed. m.mu must
+// be held.
+func (m *connManager) state(address string) *deviceConnState {
+	if s, ok := m.states[address]; ok {
+		return s
+	}
+	if len(m.states) >= maxConnStates {
+		var oldest string
+		for a, s := range m.states {
+			if oldest == "" || s.LastAttempt.Before(m.states[oldest].LastAttempt) {
+				oldest = a
+			}
+		}
+		delete(m.states, oldest)
+	}
+	s := &deviceConnState{backoff: backoff{
+		initial: time.Duration(m.config.RetryInterval),
+		max:     time.Duration(m.config.MaxRetryInterval),
+	}}
+	m.states[address] = s
+	return s
+}
+
+// record updates the state of address with an attempt that started at
+// start and failed with err, or succeeded if err is nil. Failed devices
+// are scheduled for a retry or quarantined.
+func (m *connManager) record(address string, start time.Time, err error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.state(address)
+	s.Attempts++
+	s.LastAttempt = start
+	s.LastDuration = Duration(now.Sub(start))
+	if err == nil {
+		s.ConsecutiveFailures = 0
+		s.LastError = ""
+		s.RetryAt = time.Time{}
+		s.QuarantinedUntil = time.Time{}
+		s.backoff.reset()
+		return
+	}
+
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastError = err.Error()
+	l := gattLog.WithField("address", address).WithField("failures", s.ConsecutiveFailures)
+	if q := m.config.QuarantineAfter; q > 0 && s.ConsecutiveFailures >= q {
+		s.QuarantinedUntil = now.Add(time.Duration(m.config.Quarantine))
+		s.RetryAt = s.QuarantinedUntil
+		metrics.Add("connect_quarantined", 1)
+		l.WithError(err).WithField("until", s.QuarantinedUntil).Warn("device quarantined")
+		return
+	}
+	s.RetryAt = now.Add(s.backoff.next())
+	l.WithField("retry_at", s.RetryAt).Debug("connection retry scheduled")
+}
+
+// unreachable returns the state of every device whose last connection
+// attempt failed, by address.
+func (m *connManager) unreachable() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make(map[string]deviceConnState)
+	for a, s := range m.states {
+		if s.ConsecutiveFailures > 0 {
+			devices[a] = *s
+		}
+	}
+	return devices
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DecodeConfig configures the decoding of advertisement payloads.
+type DecodeConfig struct {
+	// CompanyIDsFile is a CSV file of "id,name" rows, such as one written
+	// by "go run gen_company_ids.go -out file", that extends the built-in
+	// table of vendor names.
+	CompanyIDsFile string `json:"company_ids_file"`
+
+	// DedupeWindow is how long the sequence number of a reading is
+	// remembered, so that a reading received repeatedly or by several
+	// scanners is written once.
+	DedupeWindow Duration `json:"dedupe_window"`
+
+	// BTHomeKeys, MiBeaconKeys and VictronKeys are the bind or
+	// advertisement keys of devices that encrypt their payloads by
+	// address, each a secret reference to 32 hex digits.
+	BTHomeKeys   map[string]*Secret `json:"bthome_keys"`
+	MiBeaconKeys map[string]*Secret `json:"mibeacon_keys"`
+	VictronKeys  map[string]*Secret `json:"victron_keys"`
+}
+
+// keySets returns the bind keys of every format by config field name.
+func (c DecodeConfig) keySets() map[string]map[string]*Secret {
+	return map[string]map[string]*Secret{
+		"bthome_keys":   c.BTHomeKeys,
+		"mibeacon_keys": c.MiBeaconKeys,
+		"victron_keys":  c.VictronKeys,
+	}
+}
+
+func (c DecodeConfig) validate() error {
+	var errs []error
+	if c.DedupeWindow < Duration(time.Second) {
+		errs = append(errs, errors.New("decode.dedupe_window must be at least 1s"))
+	}
+	for name, keys := range c.keySets() {
+		for addr, key := range keys {
+			if _, err := addressBytes(addr); err != nil || addr != strings.ToUpper(addr) {
+				errs = append(errs, fmt.Errorf("decode.%s: %q is not an upper-case MAC address", name, addr))
+			}
+			if key == nil || !key.IsSet() {
+				errs = append(errs, fmt.Errorf("decode.%s[%s] is empty", name, addr))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Decoded is the typed content of an advertisement payload.
+type Decoded struct {
+	// Decoder names the decoder that produced the values. It is the
+	// measurement name in the sinks unless Measurement is set, which
+	// groups the payloads of several decoders.
+	//
+	// The decoders of the "sensor" measurement share field names and
+	// types: temperature_c in °C, humidity_pct and battery_pct in % and
+	// battery_voltage in V, all float64.
+	Decoder     string `json:"decoder"`
+	Measurement string `json:"measurement,omitempty"`
+
+	// CompanyID and Vendor identify the company of decoded manufacturer
+	// data.
+	CompanyID uint16 `json:"company_id,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+
+	// ServiceUUID identifies the service of decoded service data.
+	ServiceUUID string `json:"service_uuid,omitempty"`
+
+	// ID identifies the sender independently of its address, for senders
+	// such as beacons that rotate their address.
+	ID string `json:"id,omitempty"`
+
+	// Tags identify what the values are about, such as a beacon UUID, and
+	// Fields are the values. Neither is modified once decoded.
+	Tags   map[string]string      `json:"tags,omitempty"`
+	Fields map[string]interface{} `json:"fields"`
+
+	// Sequence numbers the readings of a sender, for deduplication.
+	Sequence *uint32 `json:"sequence,omitempty"`
+
+	// Events are the button presses and similar actions reported with the
+	// values.
+	Events []DeviceEvent `json:"events,omitempty"`
+}
+
+// DeviceEvent is an action reported by a device, such as a button press.
+// Name identifies the button or dimmer of devices that have several.
+type DeviceEvent struct {
+	Name  string `json:"name"`
+	Event string `json:"event"`
+	Steps int    `json:"steps,omitempty"`
+}
+
+// dedupeKey returns the registry claim key of a sequence numbered
+// payload, or "" if it has no sequence number.
+func (d *Decoded) dedupeKey(address string) string {
+	if d.Sequence == nil {
+		return ""
+	}
+	sender := d.ID
+	if sender == "" {
+		sender = address
+	}
+	return d.Decoder + ":" + sender + ":" + strconv.FormatUint(uint64(*d.Sequence), 10)
+}
+
+// payloadDecoder decodes one payload format of manufacturer or service
+// data of adv. companyID is the company identifier of manufacturer data,
+// which some devices fill with readings, and zero for service data.
+// decode returns nil without an error for payloads it does not
+// recognise, so that several decoders can share a company identifier or
+// service UUID, and an error for recognised but malformed ones.
+type payloadDecoder struct {
+	name   string
+	decode func(adv Advertisement, companyID uint16, data []byte) (*Decoded, error)
+}
+
+// manufacturerDecoders are tried in order for manufacturer data of their
+// company identifier, until one recognises the payload. Then
+// anyManufacturerDecoders are tried, for formats that any company may
+// use.
+var manufacturerDecoders = map[uint16][]payloadDecoder{
+	0x0001: {{"govee_h5179", decodeGoveeH5179}},
+	0x004C: {{"ibeacon", decodeIBeacon}},
+	0x0059: {{"mopeka", decodeMopeka}},
+	0x02E1: {
+		{"victron_solar_charger", decodeVictronSolarCharger},
+		{"victron_battery_monitor", decodeVictronBatteryMonitor},
+		{"victron_inverter", decodeVictronInverter},
+		{"victron_dcdc_converter", decodeVictronDCDCConverter},
+	},
+	0x0499: {
+		{"ruuvi_rawv2", decodeRuuviRAWv2},
+		{"ruuvi_rawv1", decodeRuuviRAWv1},
+	},
+	0xEC88: {{"govee_h5075", decodeGoveeH5075}},
+}
+
+var anyManufacturerDecoders = []payloadDecoder{
+	{"altbeacon", decodeAltBeacon},
+	{"inkbird", decodeInkbird},
+	{"thermopro", decodeThermoPro},
+}
+
+// serviceDataDecoders are tried in order for service data of their
+// service UUID, in the form returned by formatUUID.
+var serviceDataDecoders = map[string][]payloadDecoder{
+	"feaa": {
+		{"eddystone_uid", decodeEddystoneUID},
+		{"eddystone_url", decodeEddystoneURL},
+		{"eddystone_tlm", decodeEddystoneTLM},
+		{"eddystone_eid", decodeEddystoneEID},
+	},
+	"fcd2": {{"bthome", decodeBTHome}},
+	"fe95": {{"mibeacon", decodeMiBeacon}},
+	"fd3d": {
+		{"switchbot_meter", decodeSwitchBotMeter},
+		{"switchbot_contact", decodeSwitchBotContact},
+	},
+	"0d00": {
+		{"switchbot_meter", decodeSwitchBotMeter},
+		{"switchbot_contact", decodeSwitchBotContact},
+	},
+	"181a": {
+		{"atc", decodeATC},
+		{"pvvx", decodePVVX},
+	},
+}
+
+// decodeAdvertisement decodes every payload of adv that a decoder
+// recognises. Malformed payloads are counted and logged.
+func decodeAdvertisement(adv Advertisement) []Decoded {
+	var decoded []Decoded
+	for _, m := range adv.ManufacturerData {
+		decoders := manufacturerDecoders[m.CompanyID]
+		decoders = append(decoders[:len(decoders):len(decoders)], anyManufacturerDecoders...)
+		if d := decodePayload(adv, decoders, m.CompanyID, m.Data); d != nil {
+			d.CompanyID = m.CompanyID
+			if d.Vendor == "" {
+				d.Vendor = companyName(m.CompanyID)
+			}
+			decoded = append(decoded, *d)
+		}
+	}
+	for _, sd := range adv.ServiceData {
+		uuid := formatUUID(sd.UUID)
+		if d := decodePayload(adv, serviceDataDecoders[uuid], 0, sd.Data); d != nil {
+			d.ServiceUUID = uuid
+			decoded = append(decoded, *d)
+		}
+	}
+	return decoded
+}
+
+// hasServiceUUID reports whether adv advertises the service uuid, in the
+// form returned by formatUUID.
+func hasServiceUUID(adv Advertisement, uuid string) bool {
+	for _, u := range adv.ServiceUUIDs {
+		if formatUUID(u) == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePayload returns the payload decoded by the first of decoders
+// that recognises it, or nil.
+func decodePayload(adv Advertisement, decoders []payloadDecoder, companyID uint16, data []byte) *Decoded {
+	for _, dec := range decoders {
+		d, err := dec.decode(adv, companyID, data)
+		if err != nil {
+			metrics.Add("decode_errors", 1)
+			scanLog.WithFields(advFields(adv)).WithField("decoder", dec.name).WithError(err).Debug("decode failed")
+			return nil
+		}
+		if d != nil {
+			d.Decoder = dec.name
+			metrics.Add("decoded", 1)
+			return d
+		}
+	}
+	return nil
+}
+
+// DecodedData is emitted for every decoded advertisement payload. Senders
+// with an ID are tagged by it rather than by their address. Payloads
+// with a sequence number are written by whichever scanner claims them
+// first, so the host is a field rather than a tag.
+type DecodedData struct {
+	Time    time.Time
+	Host    string
+	Address string
+	Payload Decoded
+}
+
+func (d DecodedData) Measurement() string {
+	if d.Payload.Measurement != "" {
+		return d.Payload.Measurement
+	}
+	return d.Payload.Decoder
+}
+
+func (d DecodedData) Tags() map[string]string {
+	tags := make(map[string]string)
+	if d.Payload.ID != "" {
+		tags["id"] = d.Payload.ID
+	} else {
+		tags["address"] = d.Address
+	}
+	if d.Payload.Sequence == nil {
+		tags["host"] = d.Host
+	}
+	if d.Payload.Measurement != "" {
+		tags["decoder"] = d.Payload.Decoder
+	}
+	if d.Payload.Vendor != "" {
+		tags["vendor"] = d.Payload.Vendor
+	}
+	for k, v := range d.Payload.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (d DecodedData) Fields() map[string]interface{} {
+	if d.Payload.ID == "" && d.Payload.Sequence == nil {
+		return d.Payload.Fields
+	}
+	f := make(map[string]interface{}, len(d.Payload.Fields)+3)
+	for k, v := range d.Payload.Fields {
+		f[k] = v
+	}
+	if d.Payload.ID != "" {
+		f["address"] = d.Address
+	}
+	if d.Payload.Sequence != nil {
+		f["host"] = d.Host
+		f["sequence"] = *d.Payload.Sequence
+	}
+	return f
+}
+
+func (d DecodedData) Timestamp() time.Time { return d.Time }
+
+// EventData is emitted for every event of a decoded payload.
+type EventData struct {
+	Time    time.Time
+	Host    string
+	Address string
+	Decoder string
+	Event   DeviceEvent
+}
+
+func (e EventData) Measurement() string { return "event" }
+
+func (e EventData) Tags() map[string]string {
+	return map[string]string{
+		"address": e.Address,
+		"decoder": e.Decoder,
+		"name":    e.Event.Name,
+		"event":   e.Event.Event,
+	}
+}
+
+func (e EventData) Fields() map[string]interface{} {
+	f := map[string]interface{}{"host": e.Host}
+	if e.Event.Steps != 0 {
+		f["steps"] = e.Event.Steps
+	}
+	return f
+}
+
+func (e EventData) Timestamp() time.Time { return e.Time }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// decoderTest is an advertisement in the recording format, as read by
+// the replay backend, and the payload it should decode to.
+type decoderTest struct {
+	name    string
+	adv     string
+	decoder string // "" if no payload should be recognised
+	fields  map[string]interface{}
+	tags    map[string]string
+}
+
+func runDecoderTests(t *testing.T, vendor string, tests []decoderTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var adv Advertisement
+			if err := json.Unmarshal([]byte(tt.adv), &adv); err != nil {
+				t.Fatal(err)
+			}
+			decoded := decodeAdvertisement(adv)
+			if tt.decoder == "" {
+				if len(decoded) > 0 {
+					t.Fatalf("decoded %+v, want nothing", decoded)
+				}
+				return
+			}
+			if len(decoded) != 1 {
+				t.Fatalf("decoded %+v, want one payload", decoded)
+			}
+			d := decoded[0]
+			if d.Decoder != tt.decoder || d.Vendor != vendor {
+				t.Errorf("decoder, vendor = %q, %q, want %q, %q", d.Decoder, d.Vendor, tt.decoder, vendor)
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+			for k, v := range tt.tags {
+				if d.Tags[k] != v {
+					t.Errorf("tag %s = %q, want %q", k, d.Tags[k], v)
+				}
+			}
+			adv.Decoded = decoded
+			if v := deviceVendor(adv); v != vendor {
+				t.Errorf("device vendor = %q, want %q", v, vendor)
+			}
+		})
+	}
+}
+
+// TestSensorSchema checks that every decoder of the sensor measurement
+// writes the common fields under the same names and types, since
+// InfluxDB rejects a field whose type changes.
+func TestSensorSchema(t *testing.T) {
+	common := map[string]bool{"temperature_c": true, "humidity_pct": true, "battery_pct": true, "battery_voltage": true}
+	seen := make(map[string]bool)
+	for _, adv := range []string{
+		`{"address":"A4:C1:38:5D:41:0B","manufacturer_data":{"0xEC88":"00037c9b5800"}}`,
+		`{"address":"E3:60:59:21:80:65","manufacturer_data":{"0x0001":"0188ec000101d008941164"}}`,
+		`{"address":"49:22:05:17:2B:AE","local_name":"sps","manufacturer_data":{"0x0914":"a41000c4ed6408"}}`,
+		`{"address":"B8:59:CE:32:11:9D","local_name":"TP357 (119D)","manufacturer_data":{"0xDFC2":"002d022c"}}`,
+		`{"address":"D3:75:5A:8E:3F:6C","service_uuids":["fee5"],"manufacturer_data":{"0x0059":"036046a0c15a8e3ffa08"}}`,
+		`{"address":"D4:BD:28:1A:9C:02","service_data":{"fd3d":"54006405962d"}}`,
+		`{"address":"C7:6E:5B:AD:35:2F","manufacturer_data":{"0x0499":"0512fc5394c37c0004fffc040cac364200cdcbb8334c884f"}}`,
+		`{"address":"C7:6E:5B:AD:35:2F","manufacturer_data":{"0x0499":"03291a1ece1efc18f94202ca0b53"}}`,
+		`{"address":"A4:C1:38:66:E5:68","service_data":{"fe95":"5020aa0112010000a8654c0d1004ea00f401"}}`,
+		`{"address":"A4:C1:38:66:E5:68","service_data":{"181a":"a4c13866e56800ea325d0b8607"}}`,
+		`{"address":"A4:C1:38:66:E5:68","service_data":{"181a":"69e56638c1a429099413860b5d0805"}}`,
+		`{"address":"11:22:33:44:55:66","service_data":{"fcd2":"4002ca0903bf130161"}}`,
+		`{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"20000bb8178000000064000000e1"}}`,
+	} {
+		var a Advertisement
+		if err := json.Unmarshal([]byte(adv), &a); err != nil {
+			t.Fatal(err)
+		}
+		decoded := decodeAdvertisement(a)
+		if len(decoded) != 1 || decoded[0].Measurement != "sensor" {
+			t.Errorf("%s: decoded %+v, want one sensor payload", adv, decoded)
+			continue
+		}
+		d := decoded[0]
+		seen[d.Decoder] = true
+		for k, v := range d.Fields {
+			if k == "temperature" || k == "humidity" || k == "battery" {
+				t.Errorf("%s: field %s, want the unit suffixed name", d.Decoder, k)
+			}
+			if _, ok := v.(float64); common[k] && !ok {
+				t.Errorf("%s: %s is %T, want float64", d.Decoder, k, v)
+			}
+		}
+		if _, ok := d.Fields["temperature_c"]; !ok {
+			t.Errorf("%s: no temperature_c in %v", d.Decoder, d.Fields)
+		}
+	}
+	if len(seen) != 13 {
+		t.Errorf("decoders %v, want 13", seen)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"tinygo.org/x/bluetooth"
+)
+
+// DeviceInfo is what a device tells about itself through the standard
+// Generic Access (0x1800), Device Information (0x180A) and Battery
+// (0x180F) services.
+type DeviceInfo struct {
+	// Name is the GAP Device Name, which many devices do not advertise.
+	Name string `json:"name,omitempty"`
+
+	// Appearance is the GAP Appearance value and Category its decoded
+	// kind of device, see appearanceCategory.
+	Appearance uint16 `json:"appearance,omitempty"`
+	Category   string `json:"category,omitempty"`
+
+	ManufacturerName string `json:"manufacturer_name,omitempty"`
+	ModelNumber      string `json:"model_number,omitempty"`
+	SerialNumber     string `json:"serial_number,omitempty"`
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+	HardwareRevision string `json:"hardware_revision,omitempty"`
+	SoftwareRevision string `json:"software_revision,omitempty"`
+	PnPID            *PnPID `json:"pnp_id,omitempty"`
+
+	// BatteryLevel is the charge in percent at the time of the profile.
+	BatteryLevel *uint8 `json:"battery_level,omitempty"`
+}
+
+// PnPID identifies the product in the namespace of a vendor ID source:
+// 1 for Bluetooth SIG company IDs, 2 for USB Implementer's Forum IDs.
+type PnPID struct {
+	VendorIDSource uint8  `json:"vendor_id_source"`
+	VendorID       uint16 `json:"vendor_id"`
+	ProductID      uint16 `json:"product_id"`
+	ProductVersion uint16 `json:"product_version"`
+}
+
+// deviceInfo decodes the Generic Access, Device Information and Battery
+// services of p, falling back to the GAP values and battery level of the
+// Bluetooth stack. It returns nil if none of their values could be read.
+func (p *GATTProfile) deviceInfo() *DeviceInfo {
+	gap := formatUUID(bluetooth.ServiceUUIDGenericAccess)
+	dis := formatUUID(bluetooth.ServiceUUIDDeviceInformation)
+	value := func(service string, char bluetooth.UUID) []byte {
+		c := p.characteristic(service, formatUUID(char))
+		if c == nil {
+			return nil
+		}
+		return c.Value
+	}
+	str := func(service string, char bluetooth.UUID) string {
+		// Some devices pad their strings with NULs.
+		return strings.TrimRight(string(value(service, char)), "\x00")
+	}
+
+	info := &DeviceInfo{
+		Name:             str(gap, bluetooth.CharacteristicUUIDDeviceName),
+		ManufacturerName: str(dis, bluetooth.CharacteristicUUIDManufacturerNameString),
+		ModelNumber:      str(dis, bluetooth.CharacteristicUUIDModelNumberString),
+		SerialNumber:     str(dis, bluetooth.CharacteristicUUIDSerialNumberString),
+		FirmwareRevision: str(dis, bluetooth.CharacteristicUUIDFirmwareRevisionString),
+		HardwareRevision: str(dis, bluetooth.CharacteristicUUIDHardwareRevisionString),
+		SoftwareRevision: str(dis, bluetooth.CharacteristicUUIDSoftwareRevisionString),
+	}
+	if b := value(gap, bluetooth.CharacteristicUUIDAppearance); len(b) >= 2 {
+		info.Appearance = binary.LittleEndian.Uint16(b)
+		info.Category = appearanceCategory(info.Appearance)
+	} else if p.Appearance != 0 {
+		info.Appearance = p.Appearance
+		info.Category = appearanceCategory(info.Appearance)
+	}
+	if info.Name == "" {
+		info.Name = p.Name
+	}
+	if b := value(dis, bluetooth.CharacteristicUUIDPnPID); len(b) >= 7 {
+		info.PnPID = &PnPID{
+			VendorIDSource: b[0],
+			VendorID:       binary.LittleEndian.Uint16(b[1:]),
+			ProductID:      binary.LittleEndian.Uint16(b[3:]),
+			ProductVersion: binary.LittleEndian.Uint16(b[5:]),
+		}
+	}
+	// Values above 100 are reserved.
+	b := value(formatUUID(bluetooth.ServiceUUIDBattery), bluetooth.CharacteristicUUIDBatteryLevel)
+	if len(b) >= 1 && b[0] <= 100 {
+		level := b[0]
+		info.BatteryLevel = &level
+	} else if p.BatteryLevel != nil && *p.BatteryLevel <= 100 {
+		level := *p.BatteryLevel
+		info.BatteryLevel = &level
+	}
+
+	if *info == (DeviceInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// deviceInfoFields returns the log fields for the known values of info.
+func deviceInfoFields(info *DeviceInfo) logrus.Fields {
+	f := logrus.Fields{}
+	add := func(k, v string) {
+		if v != "" {
+			f[k] = v
+		}
+	}
+	add("gap_name", info.Name)
+	add("category", info.Category)
+	add("manufacturer", info.ManufacturerName)
+	add("model", info.ModelNumber)
+	add("serial", info.SerialNumber)
+	add("firmware", info.FirmwareRevision)
+	add("hardware", info.HardwareRevision)
+	add("software", info.SoftwareRevision)
+	if p := info.PnPID; p != nil {
+		f["pnp_id"] = fmt.Sprintf("%d:%04x:%04x:%04x", p.VendorIDSource, p.VendorID, p.ProductID, p.ProductVersion)
+	}
+	if info.BatteryLevel != nil {
+		f["battery_level"] = *info.BatteryLevel
+	}
+	return f
+}
+
+// BatteryLevel is emitted for every battery level read from a device.
+type BatteryLevel struct {
+	Time    time.Time
+	Host    string
+	Address string
+	Level   uint8
+}
+
+func (b BatteryLevel) Measurement() string { return "battery" }
+
+func (b BatteryLevel) Tags() map[string]string {
+	return map[string]string{"unit": "%", "address": b.Address, "host": b.Host}
+}
+
+func (b BatteryLevel) Fields() map[string]interface{} {
+	return map[string]interface{}{"level": b.Level}
+}
+
+func (b BatteryLevel) Timestamp() time.Time { return b.Time }
+
+// readBatteryLevel reads the battery level of p without interrogating the
+// rest of the device: from the Bluetooth stack if it claims the Battery
+// service, else from the Battery Level characteristic.
+func readBatteryLevel(p Peripheral) (uint8, error) {
+	if b, ok := p.(batteryPeripheral); ok {
+		level, ok, err := b.BatteryLevel()
+		if err != nil {
+			return 0, err
+		}
+		if ok && level <= 100 {
+			return level, nil
+		}
+	}
+	services, err := p.DiscoverServices()
+	if err != nil {
+		return 0, fmt.Errorf("discover services: %w", err)
+	}
+	for _, srvc := range services {
+		if srvc.UUID() != bluetooth.ServiceUUIDBattery {
+			continue
+		}
+		chars, err := srvc.DiscoverCharacteristics()
+		if err != nil {
+			return 0, fmt.Errorf("discover characteristics: %w", err)
+		}
+		for _, char := range chars {
+			if char.UUID() != bluetooth.CharacteristicUUIDBatteryLevel {
+				continue
+			}
+			buf := make([]byte, maxGATTValue)
+			n, err := char.Read(buf)
+			if err != nil {
+				return 0, err
+			}
+			// Values above 100 are reserved.
+			if n < 1 || buf[0] > 100 {
+				return 0, fmt.Errorf("invalid battery level %x", buf[:n])
+			}
+			return buf[0], nil
+		}
+	}
+	return 0, errors.New("no battery level characteristic")
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+// bluezPeripheral stands in for a BlueZ peripheral, which reports the GAP
+// values and the battery level outside GATT.
+type bluezPeripheral struct {
+	Peripheral
+	name       string
+	appearance uint16
+	battery    *uint8
+}
+
+func (p bluezPeripheral) GAPProperties() (string, uint16, error) {
+	return p.name, p.appearance, nil
+}
+
+func (p bluezPeripheral) BatteryLevel() (uint8, bool, error) {
+	if p.battery == nil {
+		return 0, false, nil
+	}
+	return *p.battery, true, nil
+}
+
+func TestDeviceInfoGAPProperties(t *testing.T) {
+	const address = "C8:2E:18:00:00:01"
+	battery := SimServiceConfig{UUID: "180f", Characteristics: []SimCharacteristicConfig{{UUID: "2a19", Value: hexBytes{87}}}}
+	gap := SimServiceConfig{UUID: "1800", Characteristics: []SimCharacteristicConfig{
+		{UUID: "2a00", Value: hexBytes("Keyboard K380")},
+		{UUID: "2a01", Value: hexBytes{0xc1, 0x03}},
+	}}
+	stackBattery := uint8(64)
+	tests := []struct {
+		name       string
+		gatt       []SimServiceConfig
+		battery    *uint8
+		wantName   string
+		appearance uint16
+		category   string
+		level      uint8
+	}{
+		{"GAP hidden by the stack", []SimServiceConfig{battery}, nil, "Hallway PIR", 0x0541, "motion sensor", 87},
+		{"GAP over GATT wins", []SimServiceConfig{gap, battery}, nil, "Keyboard K380", 0x03C1, "keyboard", 87},
+		{"battery hidden by the stack", []SimServiceConfig{gap}, &stackBattery, "Keyboard K380", 0x03C1, "keyboard", 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newSimulator(SimulatorConfig{Fleet: []SimGroupConfig{{Count: 1, Address: address, GATT: tt.gatt}}})
+			p, err := sim.Connect(ctx, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile, err := interrogate(bluezPeripheral{p, "Hallway PIR", 0x0541, tt.battery})
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := profile.deviceInfo()
+			if info.Name != tt.wantName || info.Appearance != tt.appearance || info.Category != tt.category {
+				t.Errorf("name, appearance, category = %q, %#04x, %q, want %q, %#04x, %q",
+					info.Name, info.Appearance, info.Category, tt.wantName, tt.appearance, tt.category)
+			}
+			if info.BatteryLevel == nil || *info.BatteryLevel != tt.level {
+				t.Errorf("battery level = %v, want %d", info.BatteryLevel, tt.level)
+			}
+		})
+	}
+}
+
+func TestReadBatteryLevel(t *testing.T) {
+	const address = "C8:2E:18:00:00:02"
+	battery := SimServiceConfig{UUID: "180f", Characteristics: []SimCharacteristicConfig{{UUID: "2a19", Value: hexBytes{87}}}}
+	stackBattery, invalid := uint8(64), uint8(101)
+	tests := []struct {
+		name    string
+		gatt    []SimServiceConfig
+		battery *uint8
+		level   uint8
+		err     bool
+	}{
+		{"claimed by the stack", nil, &stackBattery, 64, false},
+		{"GATT when the stack knows none", []SimServiceConfig{battery}, nil, 87, false},
+		{"GATT when the stack's is invalid", []SimServiceConfig{battery}, &invalid, 87, false},
+		{"no battery", nil, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newSimulator(SimulatorConfig{Fleet: []SimGroupConfig{{Count: 1, Address: address, GATT: tt.gatt}}})
+			p, err := sim.Connect(ctx, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			level, err := readBatteryLevel(bluezPeripheral{p, "", 0, tt.battery})
+			if (err != nil) != tt.err || level != tt.level {
+				t.Errorf("readBatteryLevel = %d, %v, want %d, error %v", level, err, tt.level, tt.err)
+			}
+		})
+	}
+}
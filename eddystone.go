@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Eddystone frames are service data of 0xFEAA starting with the frame
+// type, see https://github.com/google/eddystone/blob/master/protocol-specification.md.
+const (
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+	eddystoneTLM = 0x20
+	eddystoneEID = 0x30
+)
+
+// eddystoneFrame returns data if it is a frame of type t, or nil if it
+// is another type. An error is returned for frames shorter than min.
+func eddystoneFrame(data []byte, t byte, min int) ([]byte, error) {
+	if len(data) == 0 || data[0] != t {
+		return nil, nil
+	}
+	if len(data) < min {
+		return nil, fmt.Errorf("eddystone: frame 0x%02x too short: %d bytes", t, len(data))
+	}
+	return data, nil
+}
+
+// decodeEddystoneUID decodes a UID frame: the transmit power at 0m, a
+// 10-byte namespace and a 6-byte instance. The reserved bytes that may
+// follow are ignored.
+func decodeEddystoneUID(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	f, err := eddystoneFrame(data, eddystoneUID, 18)
+	if f == nil {
+		return nil, err
+	}
+	namespace, instance := hex.EncodeToString(f[2:12]), hex.EncodeToString(f[12:18])
+	return &Decoded{
+		ID:     namespace + "/" + instance,
+		Tags:   map[string]string{"namespace": namespace, "instance": instance},
+		Fields: map[string]interface{}{"tx_power": int8(f[1])},
+	}, nil
+}
+
+// eddystoneURLSchemes and eddystoneURLCodes expand the compressed URL of
+// a URL frame.
+var eddystoneURLSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+var eddystoneURLCodes = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// decodeEddystoneURL decodes a URL frame: the transmit power at 0m, the
+// URL scheme prefix and the URL with expansion codes.
+func decodeEddystoneURL(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	f, err := eddystoneFrame(data, eddystoneURL, 3)
+	if f == nil {
+		return nil, err
+	}
+	if int(f[2]) >= len(eddystoneURLSchemes) {
+		return nil, fmt.Errorf("eddystone: unknown URL scheme 0x%02x", f[2])
+	}
+	var url strings.Builder
+	url.WriteString(eddystoneURLSchemes[f[2]])
+	for _, c := range f[3:] {
+		switch {
+		case int(c) < len(eddystoneURLCodes):
+			url.WriteString(eddystoneURLCodes[c])
+		case c > 0x20 && c < 0x7f:
+			url.WriteByte(c)
+		default:
+			return nil, fmt.Errorf("eddystone: invalid URL byte 0x%02x", c)
+		}
+	}
+	return &Decoded{
+		Tags:   map[string]string{"url": url.String()},
+		Fields: map[string]interface{}{"tx_power": int8(f[1])},
+	}, nil
+}
+
+// decodeEddystoneTLM decodes an unencrypted TLM frame: the version, the
+// battery voltage in mV, the temperature in 8.8 fixed point °C, the
+// number of advertisements sent and the uptime in 0.1s since power-up.
+// The readings join those of the other sensors, see Decoded.Measurement.
+// Encrypted TLM frames are not recognised.
+func decodeEddystoneTLM(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	f, err := eddystoneFrame(data, eddystoneTLM, 2)
+	if f == nil || f[1] != 0x00 {
+		return nil, err
+	}
+	if len(f) < 14 {
+		return nil, fmt.Errorf("eddystone: TLM frame too short: %d bytes", len(f))
+	}
+	fields := map[string]interface{}{
+		"advertisement_count": binary.BigEndian.Uint32(f[6:]),
+		"uptime":              float64(binary.BigEndian.Uint32(f[10:])) / 10,
+	}
+	// Zero voltage and 0x8000 (-128 °C) mean not supported.
+	if mv := binary.BigEndian.Uint16(f[2:]); mv != 0 {
+		fields["battery_voltage"] = float64(mv) / 1000
+	}
+	if t := binary.BigEndian.Uint16(f[4:]); t != 0x8000 {
+		fields["temperature_c"] = float64(int16(t)) / 256
+	}
+	return &Decoded{Measurement: "sensor", Fields: fields}, nil
+}
+
+// decodeEddystoneEID decodes an EID frame: the transmit power at 0m and
+// an 8-byte ephemeral identifier, which only the beacon's registrar can
+// resolve. The identifier rotates, so it is a field rather than a tag,
+// which would add a series on every rotation.
+func decodeEddystoneEID(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	f, err := eddystoneFrame(data, eddystoneEID, 10)
+	if f == nil {
+		return nil, err
+	}
+	return &Decoded{
+		Fields: map[string]interface{}{"tx_power": int8(f[1]), "eid": hex.EncodeToString(f[2:10])},
+	}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestDecodeEddystoneTLM(t *testing.T) {
+	runDecoderTests(t, "", []decoderTest{
+		{name: "tlm", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"20000bb817800000006400000e10"}}`,
+			decoder: "eddystone_tlm", fields: map[string]interface{}{
+				"battery_voltage": 3.0, "temperature_c": 23.5, "advertisement_count": uint32(100), "uptime": 360.0,
+			}},
+		{name: "below zero", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"20000c1cfd80000000010000000a"}}`,
+			decoder: "eddystone_tlm", fields: map[string]interface{}{
+				"battery_voltage": 3.1, "temperature_c": -2.5, "advertisement_count": uint32(1), "uptime": 1.0,
+			}},
+		{name: "voltage and temperature not supported", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"200000008000000000020000000b"}}`,
+			decoder: "eddystone_tlm", fields: map[string]interface{}{"advertisement_count": uint32(2), "uptime": 1.1}},
+		{name: "encrypted", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"2001000102030405060708090a0b0c0d0e0f1011"}}`},
+	})
+
+	// TLM readings are written with those of the other sensors.
+	d, err := decodeEddystoneTLM(Advertisement{}, 0, mustHex(t, "20000bb8178000000064000000e1"))
+	if err != nil || d.Measurement != "sensor" {
+		t.Errorf("decoded %+v, %v, want measurement sensor", d, err)
+	}
+}
+
+func TestDecodeEddystoneEID(t *testing.T) {
+	runDecoderTests(t, "", []decoderTest{
+		{name: "eid", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"30ec0123456789abcdef"}}`,
+			decoder: "eddystone_eid", fields: map[string]interface{}{"tx_power": int8(-20), "eid": "0123456789abcdef"}},
+		{name: "too short", adv: `{"address":"D0:2B:3C:4D:5E:6F","service_data":{"feaa":"30ec0123456789abcd"}}`},
+	})
+
+	// The identifier rotates, so it must not become a series.
+	d, err := decodeEddystoneEID(Advertisement{}, 0, mustHex(t, "30ec0123456789abcdef"))
+	if err != nil || len(d.Tags) != 0 {
+		t.Errorf("decoded %+v, %v, want no tags", d, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// bluezDevice returns the BlueZ object of the device at address on the
+// adapter with the given id.
+func bluezDevice(adapterID, address string) (dbus.BusObject, error) {
+	if adapterID == "" {
+		adapterID = "hci0"
+	}
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	path := dbus.ObjectPath("/org/bluez/" + adapterID + "/dev_" + strings.ReplaceAll(address, ":", "_"))
+	return bus.Object("org.bluez", path), nil
+}
+
+// bluezProperty stores the property prop, such as
+// "org.bluez.Device1.Name", of device in v and reports whether it is set.
+func bluezProperty(device dbus.BusObject, prop string, v interface{}) (bool, error) {
+	variant, err := device.GetProperty(prop)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.InvalidArgs" {
+		// BlueZ reports unset properties, and those of interfaces the
+		// device does not have, as invalid arguments.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, variant.Store(v)
+}
+
+// gapProperties returns the Name and Appearance properties of the BlueZ
+// device at address on the adapter with the given id. BlueZ reads the
+// Generic Access service itself on connection and does not export it, so
+// this is the only way to its Device Name and Appearance. Properties
+// BlueZ does not know are returned empty.
+func gapProperties(adapterID, address string) (name string, appearance uint16, err error) {
+	device, err := bluezDevice(adapterID, address)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := bluezProperty(device, "org.bluez.Device1.Name", &name); err != nil {
+		return "", 0, err
+	}
+	if _, err := bluezProperty(device, "org.bluez.Device1.Appearance", &appearance); err != nil {
+		return "", 0, err
+	}
+	return name, appearance, nil
+}
+
+// batteryPercentage returns the Percentage property of the BlueZ device
+// at address, and false if it has none. BlueZ's battery plugin claims the
+// Battery service and does not export it, so its Battery Level is only
+// found here.
+func batteryPercentage(adapterID, address string) (level uint8, ok bool, err error) {
+	device, err := bluezDevice(adapterID, address)
+	if err != nil {
+		return 0, false, err
+	}
+	ok, err = bluezProperty(device, "org.bluez.Battery1.Percentage", &level)
+	return level, ok && err == nil, err
+}
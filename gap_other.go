@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+// gapProperties returns nothing: other platforms expose the Generic
+// Access service through GATT like any other.
+func gapProperties(adapterID, address string) (name string, appearance uint16, err error) {
+	return "", 0, nil
+}
+
+// batteryPercentage returns nothing, as other platforms expose the
+// Battery service through GATT.
+func batteryPercentage(adapterID, address string) (level uint8, ok bool, err error) {
+	return 0, false, nil
+}
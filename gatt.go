@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// GATTProfile is the service tree of a device as found by interrogation.
+type GATTProfile struct {
+	Address  string            `json:"address"`
+	Time     time.Time         `json:"time"`
+	Services []GATTServiceInfo `json:"services"`
+
+	// Name and Appearance are the GAP values reported by the Bluetooth
+	// stack when it hides the Generic Access service, see gapPeripheral.
+	Name       string `json:"name,omitempty"`
+	Appearance uint16 `json:"appearance,omitempty"`
+
+	// BatteryLevel is reported by the Bluetooth stack when it hides the
+	// Battery service, see batteryPeripheral.
+	BatteryLevel *uint8 `json:"battery_level,omitempty"`
+}
+
+// gapPeripheral is implemented by peripherals whose Bluetooth stack reads
+// the Generic Access service itself instead of exposing it through GATT,
+// as BlueZ does.
+type gapPeripheral interface {
+	GAPProperties() (name string, appearance uint16, err error)
+}
+
+// batteryPeripheral is implemented by peripherals whose Bluetooth stack
+// reads the Battery service itself, as BlueZ's battery plugin does. ok is
+// false if the stack knows no battery level for the device.
+type batteryPeripheral interface {
+	BatteryLevel() (level uint8, ok bool, err error)
+}
+
+type GATTServiceInfo struct {
+	UUID            string                   `json:"uuid"`
+	Characteristics []GATTCharacteristicInfo `json:"characteristics"`
+}
+
+type GATTCharacteristicInfo struct {
+	UUID  string   `json:"uuid"`
+	MTU   uint16   `json:"mtu,omitempty"`
+	Value hexBytes `json:"value,omitempty"`
+
+	// Error is why the value could not be read, typically because the
+	// characteristic is not readable.
+	Error string `json:"error,omitempty"`
+}
+
+// maxGATTValue is the longest attribute value allowed by the Core spec.
+const maxGATTValue = 512
+
+// interrogate walks the services and characteristics of p and reads
+// every value it can. Only a failed service discovery is an error.
+func interrogate(p Peripheral) (*GATTProfile, error) {
+	l := gattLog.WithField("address", p.Address())
+	services, err := p.DiscoverServices()
+	if err != nil {
+		return nil, fmt.Errorf("discover services: %w", err)
+	}
+	profile := &GATTProfile{Address: p.Address(), Time: time.Now()}
+	buf := make([]byte, maxGATTValue)
+	for _, srvc := range services {
+		si := GATTServiceInfo{UUID: formatUUID(srvc.UUID())}
+		chars, err := srvc.DiscoverCharacteristics()
+		if err != nil {
+			l.WithField("service", si.UUID).WithError(err).Warn("discover characteristics failed")
+		}
+		for _, char := range chars {
+			ci := GATTCharacteristicInfo{UUID: formatUUID(char.UUID())}
+			if mtu, err := char.GetMTU(); err == nil {
+				ci.MTU = mtu
+			}
+			if n, err := char.Read(buf); err != nil {
+				ci.Error = err.Error()
+			} else {
+				ci.Value = append(hexBytes(nil), buf[:n]...)
+			}
+			si.Characteristics = append(si.Characteristics, ci)
+		}
+		profile.Services = append(profile.Services, si)
+	}
+	if g, ok := p.(gapPeripheral); ok {
+		if profile.Name, profile.Appearance, err = g.GAPProperties(); err != nil {
+			l.WithError(err).Warn("read GAP properties failed")
+		}
+	}
+	if b, ok := p.(batteryPeripheral); ok {
+		if level, ok, err := b.BatteryLevel(); err != nil {
+			l.WithError(err).Warn("read battery level failed")
+		} else if ok {
+			profile.BatteryLevel = &level
+		}
+	}
+	return profile, nil
+}
+
+// characteristic returns the characteristic with the given service and
+// characteristic UUIDs, or nil.
+func (p *GATTProfile) characteristic(service, char string) *GATTCharacteristicInfo {
+	for i := range p.Services {
+		if p.Services[i].UUID != service {
+			continue
+		}
+		for j := range p.Services[i].Characteristics {
+			if p.Services[i].Characteristics[j].UUID == char {
+				return &p.Services[i].Characteristics[j]
+			}
+		}
+	}
+	return nil
+}
+
+// diffGATTProfiles describes how next differs from prev, one change per
+// line such as "characteristic 180f/2a19 value 64 -> 63".
+func diffGATTProfiles(prev, next *GATTProfile) []string {
+	var changes []string
+	services := func(p *GATTProfile) map[string]bool {
+		m := make(map[string]bool)
+		for _, s := range p.Services {
+			m[s.UUID] = true
+		}
+		return m
+	}
+	prevServices, nextServices := services(prev), services(next)
+	for _, s := range next.Services {
+		if !prevServices[s.UUID] {
+			changes = append(changes, "service "+s.UUID+" added")
+		}
+	}
+	for _, s := range prev.Services {
+		if !nextServices[s.UUID] {
+			changes = append(changes, "service "+s.UUID+" removed")
+			continue
+		}
+		for _, c := range s.Characteristics {
+			if next.characteristic(s.UUID, c.UUID) == nil {
+				changes = append(changes, "characteristic "+s.UUID+"/"+c.UUID+" removed")
+			}
+		}
+	}
+	for _, s := range next.Services {
+		if !prevServices[s.UUID] {
+			continue
+		}
+		for _, c := range s.Characteristics {
+			name := "characteristic " + s.UUID + "/" + c.UUID
+			old := prev.characteristic(s.UUID, c.UUID)
+			switch {
+			case old == nil:
+				changes = append(changes, name+" added")
+			case !bytes.Equal(old.Value, c.Value):
+				changes = append(changes, fmt.Sprintf("%s value %x -> %x", name, []byte(old.Value), []byte(c.Value)))
+			case old.MTU != c.MTU:
+				changes = append(changes, fmt.Sprintf("%s MTU %d -> %d", name, old.MTU, c.MTU))
+			}
+		}
+	}
+	return changes
+}
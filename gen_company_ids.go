@@ -0,0 +1,126 @@
+//go:build ignore
+
+// gen_company_ids converts the Bluetooth SIG's company_identifiers.yaml
+// from the assigned numbers repository into company_ids.csv. It is run
+// by "go generate" and reads the file from -in, or downloads it from -url
+// if -in is empty.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sigURL = "https://bitbucket.org/bluetooth-SIG/public/raw/main/assigned_numbers/company_identifiers/company_identifiers.yaml"
+
+type company struct {
+	id   uint16
+	name string
+}
+
+func main() {
+	in := flag.String("in", "", "company_identifiers.yaml to read instead of downloading it")
+	url := flag.String("url", sigURL, "URL of company_identifiers.yaml")
+	out := flag.String("out", "company_ids.csv", "CSV file to write")
+	flag.Parse()
+
+	var r io.Reader
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	} else {
+		resp, err := http.Get(*url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("%s: %s", *url, resp.Status)
+		}
+		r = resp.Body
+	}
+
+	companies, err := parseYAML(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(companies) == 0 {
+		log.Fatal("no company identifiers found")
+	}
+	sort.Slice(companies, func(i, j int) bool { return companies[i].id < companies[j].id })
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"id", "name"})
+	for _, c := range companies {
+		w.Write([]string{fmt.Sprintf("0x%04X", c.id), c.name})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d company identifiers to %s", len(companies), *out)
+}
+
+// parseYAML reads the "- value: 0x0000" and "name: '...'" pairs of the
+// list, which is all the file holds, without a YAML library.
+func parseYAML(r io.Reader) ([]company, error) {
+	var companies []company
+	var id *uint16
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		key, value, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(s.Text()), "- "), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "value":
+			v, err := strconv.ParseUint(value, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			n := uint16(v)
+			id = &n
+		case "name":
+			if id == nil {
+				return nil, fmt.Errorf("line %d: name without a value", line)
+			}
+			companies = append(companies, company{*id, unquote(value)})
+			id = nil
+		}
+	}
+	return companies, s.Err()
+}
+
+// unquote removes YAML single or double quotes from a scalar.
+func unquote(s string) string {
+	switch {
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package main
+
+import "encoding/binary"
+
+// decodeGoveeH5075 decodes the manufacturer data of Govee's H5072,
+// H5075 and similar thermo-hygrometers under company ID 0xEC88: a zero
+// byte, temperature and humidity packed into 24 bits big endian as
+// temperature×10000 + humidity×10 with the top bit as the temperature's
+// sign, and the battery in %.
+//
+// For example, 22.8 °C, 50.7 % and 88 % battery:
+//
+//	0xEC88: 00037c9b5800
+func decodeGoveeH5075(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) != 6 || data[0] != 0x00 {
+		return nil, nil
+	}
+	packed := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	negative := packed&0x800000 != 0
+	packed &^= 0x800000
+	temp := float64(packed/1000) / 10
+	if negative {
+		temp = -temp
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "Govee",
+		Fields: map[string]interface{}{
+			"temperature_c": temp,
+			"humidity_pct":  float64(packed%1000) / 10,
+			"battery_pct":   float64(data[4]),
+		},
+	}, nil
+}
+
+// decodeGoveeH5179 decodes the manufacturer data of Govee's H5179, which
+// uses company ID 0x0001 with Govee's own identifier 0xEC88 repeated in
+// the header: little endian temperature and humidity in hundredths and
+// the battery in %.
+//
+// For example, 22.56 °C, 45 % and 100 % battery:
+//
+//	0x0001: 0188ec000101d008941164
+func decodeGoveeH5179(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) != 11 || data[1] != 0x88 || data[2] != 0xEC {
+		return nil, nil
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "Govee",
+		Fields: map[string]interface{}{
+			"temperature_c": float64(int16(binary.LittleEndian.Uint16(data[6:]))) / 100,
+			"humidity_pct":  float64(binary.LittleEndian.Uint16(data[8:])) / 100,
+			"battery_pct":   float64(data[10]),
+		},
+	}, nil
+}
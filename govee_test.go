@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestDecodeGovee(t *testing.T) {
+	runDecoderTests(t, "Govee", []decoderTest{
+		{name: "H5075", adv: `{"address":"A4:C1:38:5D:41:0B","local_name":"GVH5075_410B","manufacturer_data":{"0xEC88":"00037c9b5800"}}`,
+			decoder: "govee_h5075", fields: map[string]interface{}{"temperature_c": 22.8, "humidity_pct": 50.7, "battery_pct": 88.0}},
+		{name: "H5075 below zero", adv: `{"address":"A4:C1:38:5D:41:0B","manufacturer_data":{"0xEC88":"00803c8c6400"}}`,
+			decoder: "govee_h5075", fields: map[string]interface{}{"temperature_c": -1.5, "humidity_pct": 50.0, "battery_pct": 100.0}},
+		{name: "H5075 other length", adv: `{"address":"A4:C1:38:5D:41:0B","manufacturer_data":{"0xEC88":"00037c9b58"}}`},
+		// The H5179 uses Nokia's company identifier, which must not name
+		// the vendor.
+		{name: "H5179", adv: `{"address":"E3:60:59:21:80:65","local_name":"Govee_H5179_8065","manufacturer_data":{"0x0001":"0188ec000101d008941164"}}`,
+			decoder: "govee_h5179", fields: map[string]interface{}{"temperature_c": 22.56, "humidity_pct": 45.0, "battery_pct": 100.0}},
+		{name: "H5179 below zero", adv: `{"address":"E3:60:59:21:80:65","manufacturer_data":{"0x0001":"0188ec00010138ff881364"}}`,
+			decoder: "govee_h5179", fields: map[string]interface{}{"temperature_c": -2.0, "humidity_pct": 50.0, "battery_pct": 100.0}},
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import "encoding/binary"
+
+// decodeInkbird decodes the manufacturer data of the Inkbird IBS-TH and
+// IBS-TH2, which advertise as "sps" and "tps". The company identifier is
+// the little endian temperature in hundredths of °C; the data is the
+// humidity in hundredths of %, whether an external probe is connected, a
+// checksum, the battery in % and the sensor type.
+//
+// For example, 23.24 °C, 42.6 % and 100 % battery:
+//
+//	0x0914: a41000c4ed6408
+func decodeInkbird(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if (adv.LocalName != "sps" && adv.LocalName != "tps") || len(data) != 7 {
+		return nil, nil
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "Inkbird",
+		Fields: map[string]interface{}{
+			"temperature_c":  float64(int16(companyID)) / 100,
+			"humidity_pct":   float64(binary.LittleEndian.Uint16(data)) / 100,
+			"external_probe": data[2] == 1,
+			"battery_pct":    float64(data[5]),
+		},
+	}, nil
+}
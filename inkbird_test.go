@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDecodeInkbird(t *testing.T) {
+	runDecoderTests(t, "Inkbird", []decoderTest{
+		{name: "IBS-TH", adv: `{"address":"49:22:05:17:2B:AE","local_name":"sps","manufacturer_data":{"0x0914":"a41000c4ed6408"}}`,
+			decoder: "inkbird", fields: map[string]interface{}{
+				"temperature_c": 23.24, "humidity_pct": 42.6, "external_probe": false, "battery_pct": 100.0,
+			}},
+		{name: "IBS-TH2", adv: `{"address":"49:22:05:17:2B:AE","local_name":"tps","manufacturer_data":{"0x0830":"0f12005ac75706"}}`,
+			decoder: "inkbird", fields: map[string]interface{}{
+				"temperature_c": 20.96, "humidity_pct": 46.23, "external_probe": false, "battery_pct": 87.0,
+			}},
+		{name: "external probe below zero", adv: `{"address":"49:22:05:17:2B:AE","local_name":"sps","manufacturer_data":{"0xFF9C":"881301abcd5008"}}`,
+			decoder: "inkbird", fields: map[string]interface{}{
+				"temperature_c": -1.0, "humidity_pct": 50.0, "external_probe": true, "battery_pct": 80.0,
+			}},
+		{name: "other name", adv: `{"address":"49:22:05:17:2B:AE","local_name":"xyz","manufacturer_data":{"0x0914":"a41000c4ed6408"}}`},
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// LogConfig configures logging. Levels are trace, debug, info, warn and
+// error; "known device" lines are logged at debug.
+type LogConfig struct {
+	// Level applies to every subsystem without an entry in Levels.
+	Level string `json:"level"`
+
+	// Levels overrides Level per subsystem: main, scan, gatt, registry
+	// and sink.
+	Levels map[string]string `json:"levels"`
+
+	// Format is "text" or "json".
+	Format string `json:"format"`
+}
+
+// Every subsystem has its own logger so that its level can be set on its
+// own. All of them write to stderr.
+var (
+	log         = newLogger("main")
+	scanLog     = newLogger("scan")
+	gattLog     = newLogger("gatt")
+	registryLog = newLogger("registry")
+	sinkLog     = newLogger("sink")
+)
+
+var loggers = map[string]*logrus.Logger{}
+
+func newLogger(subsystem string) *logrus.Entry {
+	l := logrus.New()
+	l.SetOutput(os.Stderr)
+	loggers[subsystem] = l
+	return l.WithField("subsystem", subsystem)
+}
+
+func (c LogConfig) validate() error {
+	var errs []error
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	for subsystem, level := range c.Levels {
+		if _, ok := loggers[subsystem]; !ok {
+			errs = append(errs, fmt.Errorf("log.levels: unknown subsystem %q, want one of %s", subsystem, strings.Join(subsystems(), ", ")))
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			errs = append(errs, fmt.Errorf("log.levels.%s: %w", subsystem, err))
+		}
+	}
+	switch c.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format must be text or json, got %q", c.Format))
+	}
+	return errors.Join(errs...)
+}
+
+func subsystems() []string {
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configureLogging applies c, which must have been validated, to every
+// logger. It is called again on SIGHUP.
+func configureLogging(c LogConfig) {
+	var formatter logrus.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	if c.Format == "json" {
+		formatter = &logrus.JSONFormatter{}
+	}
+	for subsystem, l := range loggers {
+		level, _ := logrus.ParseLevel(c.Level)
+		if s, ok := c.Levels[subsystem]; ok {
+			level, _ = logrus.ParseLevel(s)
+		}
+		l.SetFormatter(formatter)
+		l.SetLevel(level)
+	}
+	redis.SetLogger(redisLogger{})
+}
+
+// redisLogger sends the internal messages of go-redis, such as pool
+// errors, to the registry log.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...interface{}) {
+	registryLog.Warnf(format, v...)
+}
+
+// advFields returns the log fields describing adv.
+func advFields(adv Advertisement) logrus.Fields {
+	f := logrus.Fields{
+		"address": adv.Address,
+		"rssi":    adv.RSSI,
+		"host":    hostname,
+	}
+	if adv.LocalName != "" {
+		f["name"] = adv.LocalName
+	}
+	if len(adv.ManufacturerData) > 0 {
+		data := make([]string, len(adv.ManufacturerData))
+		for i, m := range adv.ManufacturerData {
+			data[i] = fmt.Sprintf("0x%04X:%x", m.CompanyID, m.Data)
+		}
+		f["manufacturer_data"] = strings.Join(data, ",")
+	}
+	if v := deviceVendor(adv); v != "" {
+		f["vendor"] = v
+	}
+	return f
+}
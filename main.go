@@ -2,158 +2,329 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+)
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
-	"github.com/redis/go-redis/v9"
-	"tinygo.org/x/bluetooth"
+// Exit statuses of gotooth.
+const (
+	exitOK = 0
+	// exitFailure reports a runtime error: a backend could not be set
+	// up, the scanner failed or flushing on shutdown failed.
+	exitFailure = 1
+	// exitConfig reports an invalid config or command line.
+	exitConfig = 2
+	// exitShutdownTimeout reports that the shutdown did not finish
+	// within shutdown_timeout and buffered events may have been lost.
+	exitShutdownTimeout = 3
 )
 
-var adapter = bluetooth.DefaultAdapter
-var ch chan bluetooth.ScanResult
+var cfg *Config
+var scanner Scanner
+var conns *connManager
+
+var registry DeviceRegistry
+var sink Sink
+var pipe *pipeline
+var regions *regionMonitor
 
-var rDB *redis.Client
-var influxDB influxdb2.Client
-var radioAPI api.WriteAPIBlocking
-var ctx context.Context
+// ctx is used for I/O on behalf of received advertisements. It is not
+// cancelled by a signal so that queued advertisements are still written
+// during shutdown.
+var ctx = context.Background()
 var hostname string
 var err error
 
 func main() {
-	ctx = context.Background()
-	initDatabases()
-	initBluetooth()
+	cfg, err = loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "gotooth:", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.dumpConfig {
+		b, err := cfg.dump()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gotooth: dump config:", err)
+			os.Exit(exitFailure)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if err = cfg.resolveSecrets(); err != nil {
+		fmt.Fprintln(os.Stderr, "gotooth:", err)
+		os.Exit(exitConfig)
+	}
 
-	hostname, err = os.Hostname()
+	configureLogging(cfg.Log)
+	go reloadLogLevels()
 
-	ch = make(chan bluetooth.ScanResult, 1)
-	for {
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCtx.Done()
+		// A second signal kills the process right away.
+		stop()
+		beginShutdown()
+	}()
 
-		// Start scanning.
-		println("scanning...")
-		err = adapter.Scan(processScannedDevice)
-		must("start scan", err)
-		var device bluetooth.Device
-		select {
-		case result := <-ch:
-			println("Storing device address and name")
+	status := exitOK
+	if hostname, err = os.Hostname(); err != nil {
+		err = fmt.Errorf("get hostname: %w", err)
+	} else if err = initDatabases(); err == nil {
+		if err = initBluetooth(); err == nil {
+			if conns, err = newConnManager(sigCtx, cfg.Connect); err == nil {
+				err = run(sigCtx)
+			}
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("stopping")
+		status = exitFailure
+	}
+	beginShutdown()
+	if err := shutdown(); err != nil {
+		log.WithError(err).Error("shutdown failed")
+		status = exitFailure
+	}
+	log.Info("stopped")
+	os.Exit(status)
+}
+
+// reloadLogLevels reloads the logging config on SIGHUP, for example to
+// turn debug logging on and off without a restart.
+func reloadLogLevels() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := loadConfig(os.Args[1:])
+		if err != nil {
+			log.WithError(err).Error("reload config")
+			continue
+		}
+		configureLogging(c.Log)
+		log.WithField("log_level", c.Log.Level).Info("reloaded logging config")
+	}
+}
 
-			deviceKey := fmt.Sprintf("gotooth:%s", result.Address.String())
-			err = rDB.Set(ctx, deviceKey, result.LocalName(), 0).Err()
-			if err != nil {
-				panic(err)
+// run scans until ctx is done, the scanner fails permanently or it runs
+// out of advertisements. A failed scan is restarted with backoff, and a
+// paused scan once the connection manager resumes it.
+func run(ctx context.Context) error {
+	restart := backoff{
+		initial: time.Duration(cfg.Scan.RestartInterval),
+		max:     time.Duration(cfg.Scan.MaxRestartInterval),
+	}
+	for {
+		scanLog.Info("scanning")
+		started := time.Now()
+		scanDone := make(chan error, 1)
+		go func() { scanDone <- scanner.Scan(pipe.Enqueue) }()
+		select {
+		case err := <-scanDone:
+			if err == nil {
+				// Scan returned on its own, as a replay does at the end
+				// of its file.
+				return nil
 			}
-			//knownDevices[result.Address.String()] = result.LocalName()
-			device, err = adapter.Connect(result.Address, bluetooth.ConnectionParams{})
-			if err != nil {
-				println(err.Error())
-				continue
+			err = scanError(err)
+			if isPermanent(err) {
+				return err
+			}
+			if time.Since(started) > restart.max {
+				restart.reset()
+			}
+			if !restartScan(ctx, &restart, err) {
+				return nil
+			}
+		case p := <-conns.pauses:
+			if err := stopScan(scanDone); err != nil {
+				return err
 			}
-			println("connected to ", result.Address.String())
-			//discoverDevice(device)
-			err = device.Disconnect()
-			if err != nil {
-				println(err)
+			restart.reset()
+			scanLog.Debug("scan paused for a connection")
+			close(p.stopped)
+			select {
+			case <-p.resume:
+			case <-ctx.Done():
+				return nil
 			}
+		case <-ctx.Done():
+			return stopScan(scanDone)
 		}
 	}
-
 }
 
-func initBluetooth() {
-	must("enable BLE stack", adapter.Enable())
+// stopScan stops the running scan and waits for it to return. StopScan
+// fails until Scan has actually started, so it is retried.
+func stopScan(scanDone <-chan error) error {
+	for scanner.StopScan() != nil {
+		select {
+		case err := <-scanDone:
+			return scanError(err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return scanError(<-scanDone)
 }
 
-func initDatabases() {
-	rDB = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-
-	// Create a new client using an InfluxDB server base URL and an authentication token
-	influxDB = influxdb2.NewClient(influxURL, influxToken)
-	radioAPI = influxDB.WriteAPIBlocking(influxOrg, influxBucket)
+func scanError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BackendError{cfg.Scan.Backend, "scan", err}
 }
 
-func must(action string, err error) {
-	if err != nil {
-		panic("failed to " + action + ": " + err.Error())
+// restartScan waits out the next backoff delay after the scan failed
+// with cause and re-enables the adapter, retrying until it succeeds. It
+// returns false if ctx is done first.
+func restartScan(ctx context.Context, b *backoff, cause error) bool {
+	for {
+		d := b.next()
+		scanLog.WithError(cause).WithField("delay", d.String()).Warn("scan failed, restarting")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+		}
+		metrics.Add("scan_restarts", 1)
+		if err := scanner.Enable(); err != nil {
+			cause = &BackendError{cfg.Scan.Backend, "enable", err}
+			continue
+		}
+		return true
 	}
 }
 
-var DeviceAddress string
+var shutdownOnce sync.Once
 
-func processScannedDevice(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
-	var exists bool
-	deviceKey := fmt.Sprintf("gotooth:%s", device.Address.String())
-	_, err := rDB.Get(ctx, deviceKey).Result()
+// beginShutdown starts the shutdown deadline. If the scanner, the sinks
+// and the registry are not closed by then, gotooth exits anyway.
+func beginShutdown() {
+	shutdownOnce.Do(func() {
+		timeout := time.Duration(cfg.ShutdownTimeout)
+		time.AfterFunc(timeout, func() {
+			log.WithField("timeout", timeout.String()).Error("shutdown did not finish in time")
+			os.Exit(exitShutdownTimeout)
+		})
+	})
+}
 
-	if err == redis.Nil {
-		exists = false
-	} else if err != nil {
-		panic(err)
-	} else {
-		exists = true
-	}
-
-	p := influxdb2.NewPoint("device",
-		map[string]string{"strength": "dBm", "address": device.Address.String(), "host": hostname},
-		map[string]interface{}{"last": device.RSSI},
-		time.Now())
-	// write point immediately
-	radioAPI.WritePoint(context.Background(), p)
-	if !exists {
-		println("found device:", device.Address.String(), device.RSSI, device.LocalName(), device.ManufacturerData())
-		adapter.StopScan()
-		ch <- device
-	} else {
-		println("known device:", device.Address.String(), device.RSSI, device.LocalName())
+// shutdown drains the pipeline, disconnects open devices and closes the
+// scanner, then flushes and closes the sinks and the registry.
+func shutdown() error {
+	var errs []error
+	if pipe != nil {
+		pipe.Close()
 	}
-
+	if conns != nil {
+		conns.Close()
+	}
+	if scanner != nil {
+		errs = append(errs, scanner.Close())
+	}
+	if regions != nil {
+		regions.Close()
+	}
+	if sink != nil {
+		errs = append(errs, sink.Close())
+	}
+	if registry != nil {
+		errs = append(errs, registry.Close())
+	}
+	return errors.Join(errs...)
 }
 
-func discoverDevice(device bluetooth.Device) {
-	// get services
-	println("discovering services/characteristics")
-	srvcs, err := device.DiscoverServices(nil)
-	must("discover services", err)
+func initBluetooth() error {
+	scanner, err = newScanner(cfg)
+	if err != nil {
+		return fmt.Errorf("select scanner: %w", err)
+	}
+	if err = scanner.Enable(); err != nil {
+		return fmt.Errorf("enable BLE stack: %w", err)
+	}
+	return nil
+}
 
-	// buffer to retrieve characteristic data
-	buf := make([]byte, 255)
+func initDatabases() error {
+	registry, err = newRegistry(cfg)
+	if err != nil {
+		return fmt.Errorf("configure registry: %w", err)
+	}
+	if err = loadCompanyIDs(cfg.Decode.CompanyIDsFile); err != nil {
+		return fmt.Errorf("load company identifiers: %w", err)
+	}
+	sink, err = newSink(cfg)
+	if err != nil {
+		return fmt.Errorf("configure sinks: %w", err)
+	}
+	if err = serveMetrics(cfg.Metrics); err != nil {
+		return fmt.Errorf("serve metrics: %w", err)
+	}
+	regions = newRegionMonitor(cfg.Beacons, nil)
+	pipe = newPipeline(cfg.Pipeline, processScannedDevice)
+	return nil
+}
 
-	for _, srvc := range srvcs {
-		println("- service", srvc.UUID().String())
+func processScannedDevice(device Advertisement) {
+	device.Decoded = decodeAdvertisement(device)
+	rec, isNew, err := registry.Observe(ctx, device)
+	if err != nil && !errors.Is(err, ErrCircuitOpen) {
+		registryLog.WithFields(advFields(device)).WithError(err).Warn("observe device failed")
+	}
 
-		chars, err := srvc.DiscoverCharacteristics(nil)
-		if err != nil {
-			println(err)
-		}
-		for _, char := range chars {
-			println("-- characteristic", char.UUID().String())
-			mtu, err := char.GetMTU()
-			if err != nil {
-				println("    mtu: error:", err.Error())
-			} else {
-				println("    mtu:", mtu)
-			}
-			n, err := char.Read(buf)
-			if err != nil {
-				println("    ", err.Error())
-			} else {
-				println("    data bytes", strconv.Itoa(n))
-				println("    value =", string(buf[:n]))
+	writeEvent(sinkLog.WithFields(advFields(device)), Observation{
+		Time:    device.Time,
+		Host:    hostname,
+		Address: device.Address,
+		RSSI:    device.RSSI,
+		Vendor:  deviceVendor(device),
+	})
+	for _, d := range device.Decoded {
+		regions.Observe(device.Time, d)
+		if key := d.dedupeKey(device.Address); key != "" {
+			// Without the registry, better a duplicate than a gap.
+			first, err := registry.Claim(ctx, key, time.Duration(cfg.Decode.DedupeWindow))
+			if err == nil && !first {
+				metrics.Add("decoded_duplicates", 1)
+				continue
 			}
 		}
+		// Payloads of events only have no values to write.
+		if len(d.Fields) > 0 {
+			writeEvent(sinkLog.WithFields(advFields(device)).WithField("decoder", d.Decoder), DecodedData{
+				Time:    device.Time,
+				Host:    hostname,
+				Address: device.Address,
+				Payload: d,
+			})
+		}
+		for _, e := range d.Events {
+			scanLog.WithFields(advFields(device)).WithField("decoder", d.Decoder).
+				WithField("name", e.Name).WithField("event", e.Event).Info("device event")
+			metrics.Add("device_events", 1)
+			writeEvent(sinkLog.WithFields(advFields(device)).WithField("decoder", d.Decoder), EventData{
+				Time:    device.Time,
+				Host:    hostname,
+				Address: device.Address,
+				Decoder: d.Decoder,
+				Event:   e,
+			})
+		}
 	}
-
-	err = device.Disconnect()
-	if err != nil {
-		println(err)
+	if isNew {
+		scanLog.WithFields(advFields(device)).Info("found device")
+		conns.Enqueue(device)
+	} else {
+		scanLog.WithFields(advFields(device)).Debug("known device")
+		if rec != nil {
+			conns.Revisit(device, rec)
+		}
 	}
-
 }
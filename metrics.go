@@ -0,0 +1,38 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+)
+
+// metrics holds the internal counters and gauges of gotooth. They are
+// served as JSON under "gotooth" at /debug/vars when metrics.listen is
+// set.
+var metrics = expvar.NewMap("gotooth")
+
+// MetricsConfig configures the internal metrics endpoint.
+type MetricsConfig struct {
+	// Listen is the address of the HTTP server exposing /debug/vars, for
+	// example "127.0.0.1:9100". Empty disables the server.
+	Listen string `json:"listen"`
+}
+
+// serveMetrics starts the metrics HTTP server in the background.
+func serveMetrics(c MetricsConfig) error {
+	if c.Listen == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.WithError(err).Error("metrics server stopped")
+		}
+	}()
+	return nil
+}
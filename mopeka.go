@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Mopeka tank sensors use Nordic Semiconductor's company identifier and
+// advertise the service UUID 0xFEE5.
+const mopekaServiceUUID = "fee5"
+
+// mopekaPropane are the coefficients of the speed of sound in propane by
+// temperature, which convert the echo time into a level.
+var mopekaPropane = [3]float64{0.573045, -0.002822, -0.00000535}
+
+// decodeMopeka decodes the manufacturer data of the Mopeka Pro Check
+// family: the hardware ID, the battery voltage in 1/32 V, the temperature
+// above -40 °C with the sync button in the top bit, and 14 bits of echo
+// time in µs with the reading quality from 0 to 3 in the top 2 bits,
+// followed by the end of the MAC address and the accelerometer. The tank
+// is assumed to hold propane.
+//
+// For example, 145 mm at 30 °C with a full battery:
+//
+//	0x0059: 036046a0c15a8e3ffa08
+func decodeMopeka(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) != 10 || !hasServiceUUID(adv, mopekaServiceUUID) {
+		return nil, nil
+	}
+	voltage := float64(data[1]&0x7F) / 32
+	rawTemp := float64(data[2] & 0x7F)
+	echo := float64(uint16(data[3]) | uint16(data[4]&0x3F)<<8)
+	c := mopekaPropane
+	level := echo * (c[0] + c[1]*rawTemp + c[2]*rawTemp*rawTemp)
+	// 2.2 V is empty and 2.85 V full.
+	battery := math.Max(0, math.Min(100, (voltage-2.2)/0.65*100))
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "Mopeka",
+		Tags:        map[string]string{"hardware_id": fmt.Sprintf("0x%02x", data[0]&0x7F)},
+		Fields: map[string]interface{}{
+			"tank_level_mm":   int64(level),
+			"reading_quality": int64(data[4] >> 6),
+			"temperature_c":   rawTemp - 40,
+			"battery_pct":     math.Round(battery),
+			"battery_voltage": voltage,
+			"sync_button":     data[2]&0x80 != 0,
+		},
+	}, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestDecodeMopeka(t *testing.T) {
+	runDecoderTests(t, "Mopeka", []decoderTest{
+		{name: "pro check", adv: `{"address":"D3:75:5A:8E:3F:6C","service_uuids":["fee5"],"manufacturer_data":{"0x0059":"036046a0c15a8e3ffa08"}}`,
+			decoder: "mopeka", tags: map[string]string{"hardware_id": "0x03"}, fields: map[string]interface{}{
+				"tank_level_mm": int64(145), "reading_quality": int64(3), "temperature_c": 30.0,
+				"battery_pct": 100.0, "battery_voltage": 3.0, "sync_button": false,
+			}},
+		{name: "sync button at 0 °C", adv: `{"address":"D3:75:5A:8E:3F:6C","service_uuids":["fee5"],"manufacturer_data":{"0x0059":"0c50a8e8435a8e3f0000"}}`,
+			decoder: "mopeka", tags: map[string]string{"hardware_id": "0x0c"}, fields: map[string]interface{}{
+				"tank_level_mm": int64(451), "reading_quality": int64(1), "temperature_c": 0.0,
+				"battery_pct": 46.0, "battery_voltage": 2.5, "sync_button": true,
+			}},
+		// Other devices with a Nordic Semiconductor identifier.
+		{name: "without the service UUID", adv: `{"address":"D3:75:5A:8E:3F:6C","manufacturer_data":{"0x0059":"036046a0c15a8e3ffa08"}}`},
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// PipelineConfig configures the queue between the scan callback and the
+// workers that observe, decode and write advertisements.
+type PipelineConfig struct {
+	// Workers process advertisements concurrently. Advertisements of one
+	// device always go to the same worker, so they stay in order.
+	Workers int `json:"workers"`
+
+	// QueueSize bounds the advertisements waiting for a worker, split
+	// evenly between the workers.
+	QueueSize int `json:"queue_size"`
+
+	// DropPolicy decides what happens when a worker's queue is full:
+	// "drop-newest" discards the incoming advertisement, "drop-oldest"
+	// discards the longest waiting one and "block" holds up the scan
+	// callback until there is room.
+	DropPolicy string `json:"drop_policy"`
+}
+
+func (c PipelineConfig) validate() error {
+	var errs []error
+	if c.Workers < 1 {
+		errs = append(errs, errors.New("pipeline.workers must be at least 1"))
+	}
+	if c.QueueSize < c.Workers {
+		errs = append(errs, errors.New("pipeline.queue_size must be at least pipeline.workers"))
+	}
+	switch c.DropPolicy {
+	case "drop-newest", "drop-oldest", "block":
+	default:
+		errs = append(errs, fmt.Errorf("pipeline.drop_policy must be drop-newest, drop-oldest or block, got %q", c.DropPolicy))
+	}
+	return errors.Join(errs...)
+}
+
+// pipeline hands advertisements from the scan callback to a pool of
+// workers, so that the callback never waits for Redis or InfluxDB.
+type pipeline struct {
+	policy  string
+	queues  []chan Advertisement
+	process func(Advertisement)
+	wg      sync.WaitGroup
+}
+
+func newPipeline(c PipelineConfig, process func(Advertisement)) *pipeline {
+	p := &pipeline{
+		policy:  c.DropPolicy,
+		queues:  make([]chan Advertisement, c.Workers),
+		process: process,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan Advertisement, c.QueueSize/c.Workers)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	metrics.Set("pipeline_queue_depth", expvar.Func(func() interface{} { return p.depth() }))
+	return p
+}
+
+func (p *pipeline) work(q chan Advertisement) {
+	defer p.wg.Done()
+	for adv := range q {
+		p.process(adv)
+		metrics.Add("pipeline_processed", 1)
+	}
+}
+
+// depth returns the number of queued advertisements.
+func (p *pipeline) depth() int {
+	n := 0
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Enqueue queues adv for its device's worker according to the drop
+// policy. It is called from the scan callback.
+func (p *pipeline) Enqueue(adv Advertisement) {
+	h := fnv.New32a()
+	h.Write([]byte(adv.Address))
+	q := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	switch p.policy {
+	case "block":
+		q <- adv
+	case "drop-newest":
+		select {
+		case q <- adv:
+		default:
+			metrics.Add("pipeline_dropped", 1)
+			return
+		}
+	case "drop-oldest":
+		for {
+			select {
+			case q <- adv:
+				metrics.Add("pipeline_enqueued", 1)
+				return
+			default:
+			}
+			// The worker may have made room meanwhile, so only count
+			// what was actually discarded.
+			select {
+			case <-q:
+				metrics.Add("pipeline_dropped", 1)
+			default:
+			}
+		}
+	}
+	metrics.Add("pipeline_enqueued", 1)
+}
+
+// Close processes every queued advertisement and stops the workers.
+// Enqueue must not be called afterwards.
+func (p *pipeline) Close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ConnectRule matches advertisements for the connection policy. Every
+// condition that is set must match; a list matches if any of its entries
+// does. A rule without conditions matches every device.
+type ConnectRule struct {
+	// Name identifies the rule in the logs. It defaults to "rule <n>".
+	Name string `json:"name"`
+
+	// Action is "connect" or "skip".
+	Action string `json:"action"`
+
+	// Addresses are matched case-insensitively. An entry ending in "*"
+	// matches by prefix, e.g. "AC:23:3F:*" for a vendor OUI.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// AddressType is "public" or "random".
+	AddressType string `json:"address_type,omitempty"`
+
+	// LocalName is a regular expression matched against the advertised
+	// name. Devices that advertise no name never match.
+	LocalName string `json:"local_name,omitempty"`
+
+	ManufacturerIDs []uint16 `json:"manufacturer_ids,omitempty"`
+
+	// ServiceUUIDs match advertised services and service data. The
+	// bluetooth backend only reports the services it watches for, so
+	// newConnManager adds them to watchedServiceUUIDs.
+	ServiceUUIDs []string `json:"service_uuids,omitempty"`
+
+	// MinRSSI, when not zero, only matches devices received at least
+	// this strong, in dBm.
+	MinRSSI int16 `json:"min_rssi,omitempty"`
+}
+
+// connectPolicy decides which devices the connection manager connects to.
+type connectPolicy struct {
+	passive       bool
+	defaultAction string
+	rules         []compiledRule
+}
+
+type compiledRule struct {
+	ConnectRule
+	localName *regexp.Regexp
+	services  []string
+}
+
+func newConnectPolicy(c ConnectConfig) (*connectPolicy, error) {
+	p := &connectPolicy{passive: c.Passive, defaultAction: c.DefaultAction}
+	var errs []error
+	switch c.DefaultAction {
+	case "connect", "skip":
+	default:
+		errs = append(errs, fmt.Errorf("connect.default_action must be connect or skip, got %q", c.DefaultAction))
+	}
+	for i, r := range c.Rules {
+		cr := compiledRule{ConnectRule: r}
+		if cr.Name == "" {
+			cr.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		field := fmt.Sprintf("connect.rules[%d]", i)
+		switch r.Action {
+		case "connect", "skip":
+		default:
+			errs = append(errs, fmt.Errorf("%s.action must be connect or skip, got %q", field, r.Action))
+		}
+		switch r.AddressType {
+		case "", "public", "random":
+		default:
+			errs = append(errs, fmt.Errorf("%s.address_type must be public or random, got %q", field, r.AddressType))
+		}
+		if r.LocalName != "" {
+			re, err := regexp.Compile(r.LocalName)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.local_name: %w", field, err))
+			}
+			cr.localName = re
+		}
+		for _, s := range r.ServiceUUIDs {
+			u, err := parseUUID(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.service_uuids: %w", field, err))
+				continue
+			}
+			cr.services = append(cr.services, formatUUID(u))
+		}
+		p.rules = append(p.rules, cr)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decide reports whether to connect to the device that sent adv and
+// which rule decided it: "passive", a rule name or "default".
+func (p *connectPolicy) decide(adv Advertisement) (bool, string) {
+	if p.passive {
+		return false, "passive"
+	}
+	for _, r := range p.rules {
+		if r.matches(adv) {
+			return r.Action == "connect", r.Name
+		}
+	}
+	return p.defaultAction == "connect", "default"
+}
+
+func (r *compiledRule) matches(adv Advertisement) bool {
+	if len(r.Addresses) > 0 && !matchAny(r.Addresses, func(a string) bool {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			return len(adv.Address) >= len(prefix) && strings.EqualFold(adv.Address[:len(prefix)], prefix)
+		}
+		return strings.EqualFold(adv.Address, a)
+	}) {
+		return false
+	}
+	if r.AddressType != "" && (r.AddressType == "random") != adv.RandomAddress {
+		return false
+	}
+	if r.localName != nil && (adv.LocalName == "" || !r.localName.MatchString(adv.LocalName)) {
+		return false
+	}
+	if len(r.ManufacturerIDs) > 0 && !matchAny(r.ManufacturerIDs, func(id uint16) bool {
+		for _, m := range adv.ManufacturerData {
+			if m.CompanyID == id {
+				return true
+			}
+		}
+		return false
+	}) {
+		return false
+	}
+	if len(r.services) > 0 && !matchAny(r.services, func(s string) bool {
+		for _, u := range adv.ServiceUUIDs {
+			if formatUUID(u) == s {
+				return true
+			}
+		}
+		for _, sd := range adv.ServiceData {
+			if formatUUID(sd.UUID) == s {
+				return true
+			}
+		}
+		return false
+	}) {
+		return false
+	}
+	if r.MinRSSI != 0 && adv.RSSI < r.MinRSSI {
+		return false
+	}
+	return true
+}
+
+func matchAny[T any](s []T, match func(T) bool) bool {
+	for _, v := range s {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
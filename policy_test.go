@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestConnectRuleServiceUUIDsWatched(t *testing.T) {
+	old := append([]bluetooth.UUID(nil), watchedServiceUUIDs...)
+	t.Cleanup(func() { watchedServiceUUIDs = old })
+
+	c := defaultConfig().Connect
+	c.Rules = []ConnectRule{
+		{Action: "skip", ServiceUUIDs: []string{"fe2c", "180f"}},
+		{Action: "connect", ServiceUUIDs: []string{"6e400001-b5a3-f393-e0a9-e50e24dcca9e", "fe2c"}},
+	}
+	m, err := newConnManager(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	// 180f and the Nordic UART service are watched already.
+	if len(watchedServiceUUIDs) != len(old)+1 {
+		t.Fatalf("watching %d services, want %d", len(watchedServiceUUIDs), len(old)+1)
+	}
+	if u := watchedServiceUUIDs[len(old)]; u != bluetooth.New16BitUUID(0xFE2C) {
+		t.Errorf("watching %s, want fe2c", formatUUID(u))
+	}
+
+	// What the bluetooth backend reports for the watched service is
+	// what the rule matches.
+	p, _ := newConnectPolicy(c)
+	adv := Advertisement{ServiceUUIDs: []bluetooth.UUID{bluetooth.New16BitUUID(0xFE2C)}}
+	if connect, rule := p.decide(adv); connect || rule != "rule 1" {
+		t.Errorf("decide = %v, %q, want false, rule 1", connect, rule)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknownDevice is returned by DeviceRegistry.Get for an address that
+// has never been observed.
+var ErrUnknownDevice = errors.New("registry: unknown device")
+
+// ErrNoProfile is returned by DeviceRegistry.Profile for a device that
+// has not been interrogated.
+var ErrNoProfile = errors.New("registry: no GATT profile")
+
+// DeviceRegistry stores what gotooth knows about every device it has
+// seen.
+type DeviceRegistry interface {
+	// Observe folds adv into the record of its device and returns the
+	// updated record. isNew reports whether the device was first seen by
+	// this call.
+	Observe(ctx context.Context, adv Advertisement) (rec *DeviceRecord, isNew bool, err error)
+
+	// Get returns the record for address or ErrUnknownDevice.
+	Get(ctx context.Context, address string) (*DeviceRecord, error)
+
+	// RecentlySeen returns up to limit devices last seen at or after
+	// since, most recent first. A limit of zero means no limit.
+	RecentlySeen(ctx context.Context, since time.Time, limit int) ([]*DeviceRecord, error)
+
+	// SaveProfile stores the GATT profile of a device, replacing any
+	// earlier one, and sets the InterrogatedAt time and Info of its
+	// record. Profiles must not be modified once saved.
+	SaveProfile(ctx context.Context, p *GATTProfile) error
+
+	// Profile returns the last saved GATT profile of address or
+	// ErrNoProfile.
+	Profile(ctx context.Context, address string) (*GATTProfile, error)
+
+	// Claim records key for ttl and reports whether it was not recorded
+	// yet, so that of several scanners sharing the registry only the
+	// first acts on something they all received.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+
+	Close() error
+}
+
+// DeviceRecord is the registry entry of a single device.
+type DeviceRecord struct {
+	Address   string    `json:"address"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	SeenCount int64     `json:"seen_count"`
+	LastRSSI  int16     `json:"last_rssi"`
+
+	// Names, ManufacturerIDs and ServiceUUIDs accumulate every distinct
+	// value advertised by the device.
+	Names           []string `json:"names,omitempty"`
+	ManufacturerIDs []uint16 `json:"manufacturer_ids,omitempty"`
+	ServiceUUIDs    []string `json:"service_uuids,omitempty"`
+
+	// Vendors are the known company names of ManufacturerIDs.
+	Vendors []string `json:"vendors,omitempty"`
+
+	// Decoded holds the latest payload decoded by each decoder.
+	Decoded map[string]Decoded `json:"decoded,omitempty"`
+
+	// InterrogatedAt is the time of the last saved GATT profile, and Info
+	// what was decoded from it. Info is replaced, never modified.
+	InterrogatedAt time.Time   `json:"interrogated_at"`
+	Info           *DeviceInfo `json:"info,omitempty"`
+}
+
+// Name returns the most recently added advertised name, or else the GAP
+// Device Name read on connection.
+func (r *DeviceRecord) Name() string {
+	if len(r.Names) == 0 {
+		if r.Info != nil {
+			return r.Info.Name
+		}
+		return ""
+	}
+	return r.Names[len(r.Names)-1]
+}
+
+// observe folds adv into r.
+func (r *DeviceRecord) observe(adv Advertisement) {
+	if r.FirstSeen.IsZero() || adv.Time.Before(r.FirstSeen) {
+		r.FirstSeen = adv.Time
+	}
+	if adv.Time.After(r.LastSeen) {
+		r.LastSeen = adv.Time
+		r.LastRSSI = adv.RSSI
+	}
+	r.SeenCount++
+	if adv.LocalName != "" {
+		r.Names = appendUnique(r.Names, adv.LocalName)
+	}
+	for _, m := range adv.ManufacturerData {
+		r.ManufacturerIDs = appendUnique(r.ManufacturerIDs, m.CompanyID)
+	}
+	for _, v := range advertisementVendors(adv) {
+		r.Vendors = appendUnique(r.Vendors, v)
+	}
+	for _, u := range adv.ServiceUUIDs {
+		r.ServiceUUIDs = appendUnique(r.ServiceUUIDs, formatUUID(u))
+	}
+	for _, sd := range adv.ServiceData {
+		r.ServiceUUIDs = appendUnique(r.ServiceUUIDs, formatUUID(sd.UUID))
+	}
+	for _, d := range adv.Decoded {
+		if r.Decoded == nil {
+			r.Decoded = make(map[string]Decoded)
+		}
+		r.Decoded[d.Decoder] = d
+	}
+}
+
+// clone returns a deep copy of r so callers never share registry state.
+func (r *DeviceRecord) clone() *DeviceRecord {
+	c := *r
+	c.Names = append([]string(nil), r.Names...)
+	c.ManufacturerIDs = append([]uint16(nil), r.ManufacturerIDs...)
+	c.ServiceUUIDs = append([]string(nil), r.ServiceUUIDs...)
+	c.Vendors = append([]string(nil), r.Vendors...)
+	if r.Decoded != nil {
+		c.Decoded = make(map[string]Decoded, len(r.Decoded))
+		for k, v := range r.Decoded {
+			c.Decoded[k] = v
+		}
+	}
+	return &c
+}
+
+func appendUnique[T comparable](s []T, v T) []T {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// newRegistry returns the DeviceRegistry selected by the config.
+func newRegistry(c *Config) (DeviceRegistry, error) {
+	switch c.Registry.Backend {
+	case "redis":
+		client, err := newRedisClient(c.Redis)
+		if err != nil {
+			return nil, err
+		}
+		var r DeviceRegistry = &breakerRegistry{
+			DeviceRegistry: newRedisRegistry(client, c.Registry.KeyPrefix),
+			breaker:        newBreaker("redis", c.Redis.Breaker, registryLog),
+		}
+		if c.Spool.Dir != "" {
+			if r, err = newSpoolingRegistry(r, c.Spool); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+		return r, nil
+	case "memory":
+		return newMemoryRegistry(), nil
+	}
+	return nil, fmt.Errorf("unknown registry backend %q", c.Registry.Backend)
+}
+
+// memoryRegistry is a DeviceRegistry that lives only as long as the
+// process.
+type memoryRegistry struct {
+	mu       sync.Mutex
+	devices  map[string]*DeviceRecord
+	profiles map[string]*GATTProfile
+	claims   map[string]time.Time
+
+	// liveClaims is the size of claims after the last sweep.
+	liveClaims int
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{
+		devices:  make(map[string]*DeviceRecord),
+		profiles: make(map[string]*GATTProfile),
+		claims:   make(map[string]time.Time),
+	}
+}
+
+func (m *memoryRegistry) Observe(ctx context.Context, adv Advertisement) (*DeviceRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.devices[adv.Address]
+	if !ok {
+		rec = &DeviceRecord{Address: adv.Address}
+		m.devices[adv.Address] = rec
+	}
+	rec.observe(adv)
+	return rec.clone(), !ok, nil
+}
+
+func (m *memoryRegistry) Get(ctx context.Context, address string) (*DeviceRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.devices[address]
+	if !ok {
+		return nil, ErrUnknownDevice
+	}
+	return rec.clone(), nil
+}
+
+func (m *memoryRegistry) RecentlySeen(ctx context.Context, since time.Time, limit int) ([]*DeviceRecord, error) {
+	m.mu.Lock()
+	var recs []*DeviceRecord
+	for _, rec := range m.devices {
+		if !rec.LastSeen.Before(since) {
+			recs = append(recs, rec.clone())
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(recs, func(i, j int) bool { return recs[i].LastSeen.After(recs[j].LastSeen) })
+	if limit > 0 && len(recs) > limit {
+		recs = recs[:limit]
+	}
+	return recs, nil
+}
+
+func (m *memoryRegistry) SaveProfile(ctx context.Context, p *GATTProfile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.profiles[p.Address] = p
+	if rec, ok := m.devices[p.Address]; ok {
+		rec.InterrogatedAt = p.Time
+		rec.Info = p.deviceInfo()
+	}
+	return nil
+}
+
+func (m *memoryRegistry) Profile(ctx context.Context, address string) (*GATTProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.profiles[address]
+	if !ok {
+		return nil, ErrNoProfile
+	}
+	return p, nil
+}
+
+func (m *memoryRegistry) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if exp, ok := m.claims[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	// Expired claims are swept whenever the map has doubled.
+	if len(m.claims) >= 2*m.liveClaims {
+		for k, exp := range m.claims {
+			if !now.Before(exp) {
+				delete(m.claims, k)
+			}
+		}
+		m.liveClaims = len(m.claims) + 1
+	}
+	m.claims[key] = now.Add(ttl)
+	return true, nil
+}
+
+func (m *memoryRegistry) Close() error { return nil }
+
+// spoolingRegistry queues the advertisements that its registry fails to
+// observe in a Spool and replays them once the registry is reachable
+// again. Folding advertisements into a record does not depend on their
+// order, so fresh observations need not wait for the spool to drain.
+type spoolingRegistry struct {
+	DeviceRegistry
+	spool    *Spool
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSpoolingRegistry(r DeviceRegistry, c SpoolConfig) (*spoolingRegistry, error) {
+	spool, err := openSpool(c, "registry", registryLog)
+	if err != nil {
+		return nil, err
+	}
+	s := &spoolingRegistry{
+		DeviceRegistry: r,
+		spool:          spool,
+		interval:       time.Duration(c.ReplayInterval),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go s.replay()
+	return s, nil
+}
+
+// Observe spools adv when the registry fails. The returned record then
+// only reflects adv, and the device is never reported as new so an
+// outage does not make every device look unknown.
+func (s *spoolingRegistry) Observe(ctx context.Context, adv Advertisement) (*DeviceRecord, bool, error) {
+	rec, isNew, err := s.DeviceRegistry.Observe(ctx, adv)
+	if err == nil || ctx.Err() != nil {
+		return rec, isNew, err
+	}
+	b, merr := json.Marshal(adv)
+	if merr != nil {
+		return nil, false, errors.Join(err, merr)
+	}
+	if serr := s.spool.Append(b); serr != nil {
+		return nil, false, errors.Join(err, serr)
+	}
+	metrics.Add("registry_observations_spooled", 1)
+	rec = &DeviceRecord{Address: adv.Address}
+	rec.observe(adv)
+	return rec, false, nil
+}
+
+func (s *spoolingRegistry) replay() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		if s.spool.Empty() {
+			continue
+		}
+		// One advertisement at a time, so a failure never observes an
+		// advertisement twice.
+		err := s.spool.Replay(1, func(records [][]byte) error {
+			var adv Advertisement
+			if err := json.Unmarshal(records[0], &adv); err != nil {
+				registryLog.WithError(err).Warn("dropping corrupt spooled advertisement")
+				return nil
+			}
+			adv.Decoded = decodeAdvertisement(adv)
+			_, _, err := s.DeviceRegistry.Observe(context.Background(), adv)
+			return err
+		})
+		if err != nil && !errors.Is(err, ErrCircuitOpen) {
+			registryLog.WithError(err).Warn("replaying spool failed")
+		}
+	}
+}
+
+func (s *spoolingRegistry) Close() error {
+	close(s.stop)
+	<-s.done
+	return errors.Join(s.spool.Close(), s.DeviceRegistry.Close())
+}
+
+// breakerRegistry guards a remote registry with a circuit breaker so
+// that an unreachable backend fails fast instead of stalling the scan on
+// timeouts.
+type breakerRegistry struct {
+	DeviceRegistry
+	breaker *breaker
+}
+
+// call runs fn unless the circuit is open and records its outcome.
+func (r *breakerRegistry) call(ctx context.Context, op string, fn func() error) error {
+	if !r.breaker.Allow() {
+		return &BackendError{r.breaker.name, op, ErrCircuitOpen}
+	}
+	err := fn()
+	notFound := errors.Is(err, ErrUnknownDevice) || errors.Is(err, ErrNoProfile)
+	switch {
+	case err == nil, notFound:
+		r.breaker.Success()
+	case ctx.Err() != nil:
+		// Cancelled by the caller; says nothing about the backend.
+	default:
+		r.breaker.Failure()
+	}
+	if err != nil && !notFound {
+		return &BackendError{r.breaker.name, op, err}
+	}
+	return err
+}
+
+func (r *breakerRegistry) Observe(ctx context.Context, adv Advertisement) (rec *DeviceRecord, isNew bool, err error) {
+	err = r.call(ctx, "observe", func() (err error) {
+		rec, isNew, err = r.DeviceRegistry.Observe(ctx, adv)
+		return err
+	})
+	return rec, isNew, err
+}
+
+func (r *breakerRegistry) Get(ctx context.Context, address string) (rec *DeviceRecord, err error) {
+	err = r.call(ctx, "get", func() (err error) {
+		rec, err = r.DeviceRegistry.Get(ctx, address)
+		return err
+	})
+	return rec, err
+}
+
+func (r *breakerRegistry) RecentlySeen(ctx context.Context, since time.Time, limit int) (recs []*DeviceRecord, err error) {
+	err = r.call(ctx, "recently seen", func() (err error) {
+		recs, err = r.DeviceRegistry.RecentlySeen(ctx, since, limit)
+		return err
+	})
+	return recs, err
+}
+
+func (r *breakerRegistry) SaveProfile(ctx context.Context, p *GATTProfile) error {
+	return r.call(ctx, "save profile", func() error {
+		return r.DeviceRegistry.SaveProfile(ctx, p)
+	})
+}
+
+func (r *breakerRegistry) Profile(ctx context.Context, address string) (p *GATTProfile, err error) {
+	err = r.call(ctx, "profile", func() (err error) {
+		p, err = r.DeviceRegistry.Profile(ctx, address)
+		return err
+	})
+	return p, err
+}
+
+func (r *breakerRegistry) Claim(ctx context.Context, key string, ttl time.Duration) (ok bool, err error) {
+	err = r.call(ctx, "claim", func() (err error) {
+		ok, err = r.DeviceRegistry.Claim(ctx, key, ttl)
+		return err
+	})
+	return ok, err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisWatchRetries bounds the optimistic-locking retries of Observe when
+// several scanners update the same device at once.
+const redisWatchRetries = 5
+
+// redisRegistry is a DeviceRegistry stored in Redis. Each device is a
+// hash at <prefix>:device:<address>, and the sorted set
+// <prefix>:last_seen scores every address by its last-seen Unix time so
+// recently seen devices can be listed without a key scan. GATT profiles
+// are JSON strings at <prefix>:gatt:<address>, apart from the hash so
+// that Observe does not load them. Claims are expiring keys at
+// <prefix>:claim:<key> holding the hostname of the claimant.
+type redisRegistry struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisClient(c RedisConfig) (*redis.Client, error) {
+	tlsConfig, err := c.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	// go-redis takes -1, not 0, to disable retries.
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = -1
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:      c.Addr,
+		Username:  c.Username,
+		Password:  c.Password.Value(),
+		DB:        c.DB,
+		TLSConfig: tlsConfig,
+
+		MaxRetries:      maxRetries,
+		MinRetryBackoff: time.Duration(c.RetryInterval),
+		MaxRetryBackoff: time.Duration(c.MaxRetryInterval),
+		DialTimeout:     time.Duration(c.Timeout),
+		ReadTimeout:     time.Duration(c.Timeout),
+		WriteTimeout:    time.Duration(c.Timeout),
+	}), nil
+}
+
+func newRedisRegistry(client *redis.Client, prefix string) *redisRegistry {
+	return &redisRegistry{client: client, prefix: prefix}
+}
+
+func (r *redisRegistry) deviceKey(address string) string {
+	return r.prefix + ":device:" + address
+}
+
+func (r *redisRegistry) profileKey(address string) string {
+	return r.prefix + ":gatt:" + address
+}
+
+func (r *redisRegistry) claimKey(key string) string {
+	return r.prefix + ":claim:" + key
+}
+
+func (r *redisRegistry) lastSeenKey() string {
+	return r.prefix + ":last_seen"
+}
+
+// legacyKey is the plain string key used before the registry stored
+// full records. It holds the advertised name.
+func (r *redisRegistry) legacyKey(address string) string {
+	return r.prefix + ":" + address
+}
+
+func (r *redisRegistry) Observe(ctx context.Context, adv Advertisement) (*DeviceRecord, bool, error) {
+	key := r.deviceKey(adv.Address)
+	var rec *DeviceRecord
+	var isNew bool
+	observe := func(tx *redis.Tx) error {
+		h, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		isNew = len(h) == 0
+		if isNew {
+			rec = &DeviceRecord{Address: adv.Address}
+			if isNew, err = r.migrateLegacy(ctx, tx, rec); err != nil {
+				return err
+			}
+		} else if rec, err = decodeDeviceRecord(adv.Address, h); err != nil {
+			return err
+		}
+		rec.observe(adv)
+		fields, err := encodeDeviceRecord(rec)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, fields)
+			p.ZAdd(ctx, r.lastSeenKey(), redis.Z{Score: float64(rec.LastSeen.Unix()), Member: rec.Address})
+			p.Del(ctx, r.legacyKey(adv.Address))
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < redisWatchRetries; i++ {
+		err := r.client.Watch(ctx, observe, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return rec, isNew, err
+	}
+	return nil, false, redis.TxFailedErr
+}
+
+// stringGetter is the part of a transaction that migrateLegacy reads
+// with.
+type stringGetter interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+}
+
+// migrateLegacy imports the name stored under the legacy key, if any,
+// and reports whether the device is still new.
+func (r *redisRegistry) migrateLegacy(ctx context.Context, tx stringGetter, rec *DeviceRecord) (bool, error) {
+	name, err := tx.Get(ctx, r.legacyKey(rec.Address)).Result()
+	if err == redis.Nil {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if name != "" {
+		rec.Names = append(rec.Names, name)
+	}
+	return false, nil
+}
+
+func (r *redisRegistry) Get(ctx context.Context, address string) (*DeviceRecord, error) {
+	h, err := r.client.HGetAll(ctx, r.deviceKey(address)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(h) == 0 {
+		return nil, ErrUnknownDevice
+	}
+	return decodeDeviceRecord(address, h)
+}
+
+func (r *redisRegistry) RecentlySeen(ctx context.Context, since time.Time, limit int) ([]*DeviceRecord, error) {
+	addrs, err := r.client.ZRevRangeByScore(ctx, r.lastSeenKey(), &redis.ZRangeBy{
+		Min:   strconv.FormatInt(since.Unix(), 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds, err := r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, addr := range addrs {
+			p.HGetAll(ctx, r.deviceKey(addr))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*DeviceRecord, 0, len(addrs))
+	for i, cmd := range cmds {
+		h := cmd.(*redis.MapStringStringCmd).Val()
+		if len(h) == 0 {
+			continue
+		}
+		rec, err := decodeDeviceRecord(addrs[i], h)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func (r *redisRegistry) SaveProfile(ctx context.Context, p *GATTProfile) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	var info []byte
+	if i := p.deviceInfo(); i != nil {
+		if info, err = json.Marshal(i); err != nil {
+			return err
+		}
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.profileKey(p.Address), b, 0)
+		pipe.HSet(ctx, r.deviceKey(p.Address), "interrogated_at", p.Time.Format(time.RFC3339Nano))
+		if info != nil {
+			pipe.HSet(ctx, r.deviceKey(p.Address), "info", string(info))
+		} else {
+			pipe.HDel(ctx, r.deviceKey(p.Address), "info")
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisRegistry) Profile(ctx context.Context, address string) (*GATTProfile, error) {
+	b, err := r.client.Get(ctx, r.profileKey(address)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNoProfile
+	} else if err != nil {
+		return nil, err
+	}
+	p := new(GATTProfile)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("registry: corrupt GATT profile for %s: %w", address, err)
+	}
+	return p, nil
+}
+
+func (r *redisRegistry) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, r.claimKey(key), hostname, ttl).Result()
+}
+
+func (r *redisRegistry) Close() error {
+	return r.client.Close()
+}
+
+// encodeDeviceRecord flattens rec into hash fields. Lists are stored as
+// JSON arrays. Decoded values that JSON cannot represent are an error.
+func encodeDeviceRecord(rec *DeviceRecord) (map[string]interface{}, error) {
+	var errs []error
+	marshal := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		errs = append(errs, err)
+		return string(b)
+	}
+	h := map[string]interface{}{
+		"first_seen":       rec.FirstSeen.Format(time.RFC3339Nano),
+		"last_seen":        rec.LastSeen.Format(time.RFC3339Nano),
+		"seen_count":       rec.SeenCount,
+		"last_rssi":        rec.LastRSSI,
+		"names":            marshal(rec.Names),
+		"manufacturer_ids": marshal(rec.ManufacturerIDs),
+		"service_uuids":    marshal(rec.ServiceUUIDs),
+		"vendors":          marshal(rec.Vendors),
+	}
+	if len(rec.Decoded) > 0 {
+		h["decoded"] = marshal(rec.Decoded)
+	}
+	if !rec.InterrogatedAt.IsZero() {
+		h["interrogated_at"] = rec.InterrogatedAt.Format(time.RFC3339Nano)
+	}
+	if rec.Info != nil {
+		h["info"] = marshal(rec.Info)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("registry: encode record for %s: %w", rec.Address, err)
+	}
+	return h, nil
+}
+
+func decodeDeviceRecord(address string, h map[string]string) (*DeviceRecord, error) {
+	rec := &DeviceRecord{Address: address}
+	var errs []error
+	parseTime := func(field string, t *time.Time) {
+		if v, ok := h[field]; ok {
+			var err error
+			*t, err = time.Parse(time.RFC3339Nano, v)
+			errs = append(errs, err)
+		}
+	}
+	parseInt := func(field string, bits int) int64 {
+		v, ok := h[field]
+		if !ok {
+			return 0
+		}
+		n, err := strconv.ParseInt(v, 10, bits)
+		errs = append(errs, err)
+		return n
+	}
+	parseJSON := func(field string, v interface{}) {
+		if s, ok := h[field]; ok {
+			errs = append(errs, json.Unmarshal([]byte(s), v))
+		}
+	}
+
+	parseTime("first_seen", &rec.FirstSeen)
+	parseTime("last_seen", &rec.LastSeen)
+	parseTime("interrogated_at", &rec.InterrogatedAt)
+	rec.SeenCount = parseInt("seen_count", 64)
+	rec.LastRSSI = int16(parseInt("last_rssi", 16))
+	parseJSON("names", &rec.Names)
+	parseJSON("manufacturer_ids", &rec.ManufacturerIDs)
+	parseJSON("service_uuids", &rec.ServiceUUIDs)
+	parseJSON("vendors", &rec.Vendors)
+	parseJSON("decoded", &rec.Decoded)
+	parseJSON("info", &rec.Info)
+	if err := errors.Join(errs...); err != nil {
+		return nil, errors.Join(errors.New("registry: corrupt record for "+address), err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// legacyKeys is a stringGetter holding the plain string keys of the
+// legacy registry, or failing every read with err.
+type legacyKeys struct {
+	keys map[string]string
+	err  error
+}
+
+func (k legacyKeys) Get(ctx context.Context, key string) *redis.StringCmd {
+	if k.err != nil {
+		return redis.NewStringResult("", k.err)
+	}
+	v, ok := k.keys[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	keys := map[string]string{
+		"gotooth:C4:7C:8D:6A:1B:2E": "Flower care",
+		"gotooth:A4:C1:38:5D:41:0B": "",
+	}
+	for _, tt := range []struct {
+		prefix, address string
+		getErr          error
+		isNew           bool
+		names           []string
+		err             bool
+	}{
+		{prefix: "gotooth", address: "C4:7C:8D:6A:1B:2E", names: []string{"Flower care"}},
+		{prefix: "gotooth", address: "A4:C1:38:5D:41:0B"},
+		{prefix: "gotooth", address: "D0:2B:3C:4D:5E:6F", isNew: true},
+		{prefix: "other", address: "C4:7C:8D:6A:1B:2E", isNew: true},
+		{prefix: "gotooth", address: "C4:7C:8D:6A:1B:2E", getErr: errors.New("connection refused"), err: true},
+	} {
+		r := newRedisRegistry(nil, tt.prefix)
+		rec := &DeviceRecord{Address: tt.address}
+		isNew, err := r.migrateLegacy(context.Background(), legacyKeys{keys, tt.getErr}, rec)
+		if (err != nil) != tt.err || isNew != tt.isNew || !reflect.DeepEqual(rec.Names, tt.names) {
+			t.Errorf("%s:%s: isNew %v, names %q, err %v", tt.prefix, tt.address, isNew, rec.Names, err)
+		}
+	}
+}
+
+func TestDeviceRecordEncoding(t *testing.T) {
+	seq := uint32(205)
+	level := uint8(87)
+	rec := &DeviceRecord{
+		Address:         "C7:6E:5B:AD:35:2F",
+		FirstSeen:       time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC),
+		LastSeen:        time.Date(2024, 5, 1, 9, 30, 0, 250, time.UTC),
+		SeenCount:       1234,
+		LastRSSI:        -71,
+		Names:           []string{"Ruuvi 352F"},
+		ManufacturerIDs: []uint16{0x0499},
+		ServiceUUIDs:    []string{"6e400001-b5a3-f393-e0a9-e50e24dcca9e"},
+		Vendors:         []string{"Ruuvi Innovations Ltd."},
+		Decoded: map[string]Decoded{"ruuvi_rawv2": {
+			Decoder: "ruuvi_rawv2", Measurement: "sensor", CompanyID: 0x0499, Vendor: "Ruuvi Innovations Ltd.",
+			Fields:   map[string]interface{}{"temperature_c": 24.3, "mac": "CBB8334C884F"},
+			Sequence: &seq,
+		}},
+		InterrogatedAt: time.Date(2024, 4, 30, 18, 0, 0, 0, time.UTC),
+		Info:           &DeviceInfo{Name: "Ruuvi 352F", ManufacturerName: "Ruuvi Innovations Ltd", BatteryLevel: &level},
+	}
+	fields, err := encodeDeviceRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Redis stores every hash value as a string.
+	h := make(map[string]string, len(fields))
+	for k, v := range fields {
+		h[k] = fmt.Sprint(v)
+	}
+	got, err := decodeDeviceRecord(rec.Address, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("decoded %+v, want %+v", got, rec)
+	}
+
+	// A device seen but not interrogated has neither field.
+	fields, err = encodeDeviceRecord(&DeviceRecord{Address: rec.Address, FirstSeen: rec.FirstSeen, LastSeen: rec.LastSeen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"decoded", "interrogated_at", "info"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("encoded %s of an empty record", k)
+		}
+	}
+
+	for field, v := range map[string]string{
+		"first_seen": "yesterday",
+		"last_rssi":  "-70000",
+		"names":      `["unterminated`,
+	} {
+		h := map[string]string{"first_seen": "2024-05-01T09:00:00Z", "last_rssi": "-70", "names": "[]"}
+		h[field] = v
+		if _, err := decodeDeviceRecord(rec.Address, h); err == nil || !strings.Contains(err.Error(), "corrupt record for "+rec.Address) {
+			t.Errorf("%s %q: err = %v", field, v, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestMemoryRegistryObserve(t *testing.T) {
+	r := newMemoryRegistry()
+	ctx := context.Background()
+	const address = "A4:C1:38:5D:41:0B"
+	t0 := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	adv := func(at time.Duration, rssi int16, name string) Advertisement {
+		return Advertisement{
+			Time: t0.Add(at), Address: address, RSSI: rssi, LocalName: name,
+			ManufacturerData: []bluetooth.ManufacturerDataElement{{CompanyID: 0xEC88, Data: []byte{0x00, 0x03, 0x7c, 0x9b, 0x58, 0x00}}},
+		}
+	}
+
+	if _, err := r.Get(ctx, address); !errors.Is(err, ErrUnknownDevice) {
+		t.Fatalf("Get before Observe: %v", err)
+	}
+	for _, tt := range []struct {
+		adv       Advertisement
+		isNew     bool
+		firstSeen time.Duration
+		lastSeen  time.Duration
+		rssi      int16
+		names     []string
+	}{
+		{adv: adv(0, -60, "GVH5075_410B"), isNew: true, rssi: -60, names: []string{"GVH5075_410B"}},
+		{adv: adv(time.Minute, -65, ""), lastSeen: time.Minute, rssi: -65, names: []string{"GVH5075_410B"}},
+		{adv: adv(time.Minute, -65, "GVH5075_410B"), lastSeen: time.Minute, rssi: -65, names: []string{"GVH5075_410B"}},
+		// Advertisements relayed late do not move last_seen back.
+		{adv: adv(-time.Minute, -80, "Govee"), firstSeen: -time.Minute, lastSeen: time.Minute, rssi: -65, names: []string{"GVH5075_410B", "Govee"}},
+	} {
+		rec, isNew, err := r.Observe(ctx, tt.adv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isNew != tt.isNew || !rec.FirstSeen.Equal(t0.Add(tt.firstSeen)) || !rec.LastSeen.Equal(t0.Add(tt.lastSeen)) ||
+			rec.LastRSSI != tt.rssi || !reflect.DeepEqual(rec.Names, tt.names) {
+			t.Errorf("observe %v: isNew %v, record %+v", tt.adv.Time, isNew, rec)
+		}
+	}
+
+	rec, err := r.Get(ctx, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.SeenCount != 4 || !reflect.DeepEqual(rec.ManufacturerIDs, []uint16{0xEC88}) {
+		t.Errorf("record %+v", rec)
+	}
+	// Records are copies.
+	rec.Names[0] = "changed"
+	if rec, _ := r.Get(ctx, address); rec.Names[0] != "GVH5075_410B" {
+		t.Errorf("record shares names with the registry: %q", rec.Names)
+	}
+}
+
+func TestMemoryRegistryRecentlySeen(t *testing.T) {
+	r := newMemoryRegistry()
+	ctx := context.Background()
+	t0 := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		address := fmt.Sprintf("A4:C1:38:5D:41:0%d", i)
+		if _, _, err := r.Observe(ctx, Advertisement{Time: t0.Add(time.Duration(i) * time.Minute), Address: address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		since time.Time
+		limit int
+		want  []string
+	}{
+		{limit: 0, want: []string{"A4:C1:38:5D:41:03", "A4:C1:38:5D:41:02", "A4:C1:38:5D:41:01", "A4:C1:38:5D:41:00"}},
+		{limit: 2, want: []string{"A4:C1:38:5D:41:03", "A4:C1:38:5D:41:02"}},
+		{since: t0.Add(2 * time.Minute), want: []string{"A4:C1:38:5D:41:03", "A4:C1:38:5D:41:02"}},
+		{since: t0.Add(time.Hour)},
+	} {
+		recs, err := r.RecentlySeen(ctx, tt.since, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rec := range recs {
+			got = append(got, rec.Address)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("since %v, limit %d: %q, want %q", tt.since, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRegistryClaim(t *testing.T) {
+	r := newMemoryRegistry()
+	ctx := context.Background()
+	claim := func(key string, ttl time.Duration) bool {
+		t.Helper()
+		first, err := r.Claim(ctx, key, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return first
+	}
+
+	if !claim("ruuvi_rawv2:CB:B8:33:4C:88:4F:205", time.Hour) {
+		t.Error("first claim refused")
+	}
+	if claim("ruuvi_rawv2:CB:B8:33:4C:88:4F:205", time.Hour) {
+		t.Error("claim granted twice within its window")
+	}
+	if !claim("ruuvi_rawv2:CB:B8:33:4C:88:4F:206", time.Hour) {
+		t.Error("claim of another key refused")
+	}
+
+	if !claim("short", time.Millisecond) {
+		t.Error("first claim refused")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !claim("short", time.Hour) {
+		t.Error("claim refused after its window")
+	}
+
+	// Expired claims do not accumulate.
+	for i := 0; i < 100; i++ {
+		claim(fmt.Sprint("expired-", i), -time.Second)
+	}
+	r.mu.Lock()
+	n := len(r.claims)
+	r.mu.Unlock()
+	if n > 2*4 {
+		t.Errorf("%d claims kept, want at most 8", n)
+	}
+	if claim("short", time.Hour) {
+		t.Error("live claim swept")
+	}
+}
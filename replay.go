@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReplayConfig configures the replay scan backend, which plays back a
+// file written with scan.record.
+type ReplayConfig struct {
+	File string `json:"file"`
+
+	// Speed scales the recorded gaps between advertisements; 2 plays
+	// twice as fast. Zero replays without any delay.
+	Speed float64 `json:"speed"`
+
+	// Loop restarts the recording when it ends instead of stopping.
+	Loop bool `json:"loop"`
+}
+
+// replayScanner is a Scanner that reads JSON lines of Advertisement. The
+// timestamps are rewritten to the time of replay.
+type replayScanner struct {
+	config ReplayConfig
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func newReplayScanner(c ReplayConfig) *replayScanner {
+	return &replayScanner{config: c}
+}
+
+func (r *replayScanner) Enable() error {
+	_, err := os.Stat(r.config.File)
+	return err
+}
+
+func (r *replayScanner) Scan(fn func(Advertisement)) error {
+	r.mu.Lock()
+	if r.stop != nil {
+		r.mu.Unlock()
+		return errors.New("replay: already scanning")
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	r.mu.Unlock()
+
+	for {
+		done, err := r.play(stop, fn)
+		if err != nil || done || !r.config.Loop {
+			return err
+		}
+	}
+}
+
+// play replays the file once. done reports whether StopScan was called.
+func (r *replayScanner) play(stop chan struct{}, fn func(Advertisement)) (done bool, err error) {
+	f, err := os.Open(r.config.File)
+	if err != nil {
+		return false, permanent(err)
+	}
+	defer f.Close()
+
+	var prev time.Time
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var adv Advertisement
+		if err := json.Unmarshal(sc.Bytes(), &adv); err != nil {
+			return false, permanent(fmt.Errorf("%s:%d: %w", r.config.File, line, err))
+		}
+		var wait time.Duration
+		if r.config.Speed > 0 && !prev.IsZero() && adv.Time.After(prev) {
+			wait = time.Duration(float64(adv.Time.Sub(prev)) / r.config.Speed)
+		}
+		prev = adv.Time
+		select {
+		case <-stop:
+			return true, nil
+		case <-time.After(wait):
+		}
+		adv.Time = time.Now()
+		fn(adv)
+	}
+	return false, permanent(sc.Err())
+}
+
+func (r *replayScanner) StopScan() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		return errors.New("replay: not scanning")
+	}
+	close(r.stop)
+	r.stop = nil
+	return nil
+}
+
+func (r *replayScanner) Connect(ctx context.Context, address string) (Peripheral, error) {
+	return nil, errNotConnectable
+}
+
+func (r *replayScanner) Close() error { return nil }
+
+// recorder wraps a Scanner and appends every advertisement to a file in
+// the format read by the replay backend.
+type recorder struct {
+	Scanner
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newRecorder(s Scanner, path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	return &recorder{Scanner: s, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) Scan(fn func(Advertisement)) error {
+	return r.Scanner.Scan(func(adv Advertisement) {
+		r.mu.Lock()
+		if err := r.enc.Encode(adv); err != nil {
+			scanLog.WithError(err).Warn("recording advertisement failed")
+		}
+		r.mu.Unlock()
+		fn(adv)
+	})
+}
+
+// Close closes the recording and the wrapped Scanner.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(r.f.Close(), r.Scanner.Close())
+}
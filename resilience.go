@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackendError is a failure of an external backend: Redis, InfluxDB or
+// the scan backend.
+type BackendError struct {
+	Backend string
+	Op      string
+	Err     error
+}
+
+func (e *BackendError) Error() string { return e.Backend + ": " + e.Op + ": " + e.Err.Error() }
+func (e *BackendError) Unwrap() error { return e.Err }
+
+// ErrCircuitOpen is returned instead of calling a backend whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// permanentError marks an error that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying. It returns nil for nil.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// backoff yields exponentially growing delays from initial up to max.
+// Each delay is randomized into [d/2, d) so that several scanners do not
+// retry in lockstep.
+type backoff struct {
+	initial, max time.Duration
+	attempt      int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.initial << b.attempt
+	if d <= 0 || d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() { b.attempt = 0 }
+
+// BreakerConfig configures a circuit breaker.
+type BreakerConfig struct {
+	// Failures in a row open the circuit. Zero disables the breaker.
+	Failures int `json:"failures"`
+
+	// Cooldown is how long an open circuit rejects calls before a single
+	// probe is let through.
+	Cooldown Duration `json:"cooldown"`
+}
+
+func (c BreakerConfig) validate(name string) error {
+	if c.Failures < 0 {
+		return errors.New(name + ".breaker.failures must not be negative")
+	}
+	if c.Failures > 0 && c.Cooldown < Duration(time.Second) {
+		return errors.New(name + ".breaker.cooldown must be at least 1s")
+	}
+	return nil
+}
+
+// breaker is a circuit breaker. After config.Failures consecutive
+// failures it opens and Allow rejects calls for config.Cooldown. Then
+// one probe is allowed: a success closes the circuit, a failure keeps it
+// open for another cooldown.
+type breaker struct {
+	name   string
+	config BreakerConfig
+	log    *logrus.Entry
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(name string, c BreakerConfig, log *logrus.Entry) *breaker {
+	b := &breaker{name: name, config: c, log: log.WithField("backend", name)}
+	metrics.Set(name+"_circuit_open", expvar.Func(func() interface{} { return b.isOpen() }))
+	return b
+}
+
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.config.Failures > 0 && b.failures >= b.config.Failures
+}
+
+// Allow reports whether the backend may be called.
+func (b *breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Failures == 0 || b.failures < b.config.Failures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Half-open: hold off everyone else until the probe has finished.
+	b.openUntil = now.Add(time.Duration(b.config.Cooldown))
+	return true
+}
+
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Failures > 0 && b.failures >= b.config.Failures {
+		b.log.Info("circuit closed, backend is reachable again")
+	}
+	b.failures = 0
+}
+
+func (b *breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Failures == 0 {
+		return
+	}
+	b.failures++
+	if b.failures < b.config.Failures {
+		return
+	}
+	if b.failures == b.config.Failures {
+		metrics.Add(b.name+"_circuit_opened", 1)
+		b.log.WithField("failures", b.failures).Warn("circuit open, continuing in degraded mode")
+	}
+	b.openUntil = time.Now().Add(time.Duration(b.config.Cooldown))
+}
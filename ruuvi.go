@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RuuviTag data formats, see https://docs.ruuvi.com/communication/bluetooth-advertisements.
+// Both are written to the "sensor" measurement with pressure in hPa,
+// acceleration in g, battery voltage in V and TX power in dBm besides the
+// common fields. Values the tag reports as invalid are left out.
+const (
+	ruuviRAWv1 = 0x03
+	ruuviRAWv2 = 0x05
+)
+
+// decodeRuuviRAWv2 decodes data format 5: big endian temperature in
+// 0.005 °C, humidity in 0.0025 %, pressure in Pa offset by -50000,
+// acceleration on three axes in mG, 11 bits of battery voltage above
+// 1.6 V in mV and 5 bits of TX power above -40 dBm in 2 dBm steps, the
+// movement counter, the measurement sequence number and the MAC address.
+func decodeRuuviRAWv2(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) == 0 || data[0] != ruuviRAWv2 {
+		return nil, nil
+	}
+	if len(data) < 24 {
+		return nil, fmt.Errorf("ruuvi: RAWv2 frame too short: %d bytes", len(data))
+	}
+	u16 := func(i int) uint16 { return binary.BigEndian.Uint16(data[i:]) }
+	fields := make(map[string]interface{})
+	if t := u16(1); t != 0x8000 {
+		fields["temperature_c"] = float64(int16(t)) * 0.005
+	}
+	if h := u16(3); h != 0xFFFF {
+		fields["humidity_pct"] = float64(h) * 0.0025
+	}
+	if p := u16(5); p != 0xFFFF {
+		fields["pressure"] = (float64(p) + 50000) / 100
+	}
+	for i, axis := range []string{"x", "y", "z"} {
+		if a := u16(7 + 2*i); a != 0x8000 {
+			fields["acceleration_"+axis] = float64(int16(a)) / 1000
+		}
+	}
+	power := u16(13)
+	if mv := power >> 5; mv != 0x7FF {
+		fields["battery_voltage"] = float64(mv+1600) / 1000
+	}
+	if tx := power & 0x1F; tx != 0x1F {
+		fields["tx_power"] = int(tx)*2 - 40
+	}
+	if m := data[15]; m != 0xFF {
+		fields["movement_counter"] = m
+	}
+	if mac := fmt.Sprintf("%X", data[18:24]); mac != "FFFFFFFFFFFF" {
+		fields["mac"] = mac
+	}
+	d := &Decoded{Measurement: "sensor", Fields: fields}
+	if seq := u16(16); seq != 0xFFFF {
+		s := uint32(seq)
+		d.Sequence = &s
+	}
+	return d, nil
+}
+
+// decodeRuuviRAWv1 decodes data format 3: humidity in 0.5 %, temperature
+// as a sign-and-magnitude integer and hundredths, pressure in Pa offset
+// by -50000, acceleration on three axes in mG and the battery voltage in
+// mV. It has no sequence number, so its readings are not deduplicated.
+func decodeRuuviRAWv1(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) == 0 || data[0] != ruuviRAWv1 {
+		return nil, nil
+	}
+	if len(data) < 14 {
+		return nil, fmt.Errorf("ruuvi: RAWv1 frame too short: %d bytes", len(data))
+	}
+	u16 := func(i int) uint16 { return binary.BigEndian.Uint16(data[i:]) }
+	temp := float64(data[2]&0x7F) + float64(data[3])/100
+	if data[2]&0x80 != 0 {
+		temp = -temp
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Fields: map[string]interface{}{
+			"humidity_pct":    float64(data[1]) / 2,
+			"temperature_c":   temp,
+			"pressure":        (float64(u16(4)) + 50000) / 100,
+			"acceleration_x":  float64(int16(u16(6))) / 1000,
+			"acceleration_y":  float64(int16(u16(8))) / 1000,
+			"acceleration_z":  float64(int16(u16(10))) / 1000,
+			"battery_voltage": float64(u16(12)) / 1000,
+		},
+	}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// The test vectors are those of the data format specifications.
+func TestDecodeRuuvi(t *testing.T) {
+	const ruuvi = "Ruuvi Innovations Ltd."
+	adv := func(data string) string {
+		return `{"address":"CB:B8:33:4C:88:4F","manufacturer_data":{"0x0499":"` + data + `"}}`
+	}
+	runDecoderTests(t, ruuvi, []decoderTest{
+		{name: "RAWv2 valid", adv: adv("0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F"),
+			decoder: "ruuvi_rawv2", fields: map[string]interface{}{
+				"temperature_c": 24.3, "humidity_pct": 53.49, "pressure": 1000.44,
+				"acceleration_x": 0.004, "acceleration_y": -0.004, "acceleration_z": 1.036,
+				"battery_voltage": 2.977, "tx_power": 4, "movement_counter": uint8(66), "mac": "CBB8334C884F",
+			}},
+		{name: "RAWv2 maximum", adv: adv("057FFFFFFEFFFE7FFF7FFF7FFFFFDEFEFFFECBB8334C884F"),
+			decoder: "ruuvi_rawv2", fields: map[string]interface{}{
+				"temperature_c": 163.835, "humidity_pct": 163.835, "pressure": 1155.34,
+				"acceleration_x": 32.767, "acceleration_y": 32.767, "acceleration_z": 32.767,
+				"battery_voltage": 3.646, "tx_power": 20, "movement_counter": uint8(254), "mac": "CBB8334C884F",
+			}},
+		{name: "RAWv2 minimum", adv: adv("058001000000008001800180010000000000CBB8334C884F"),
+			decoder: "ruuvi_rawv2", fields: map[string]interface{}{
+				"temperature_c": -163.835, "humidity_pct": 0.0, "pressure": 500.0,
+				"acceleration_x": -32.767, "acceleration_y": -32.767, "acceleration_z": -32.767,
+				"battery_voltage": 1.6, "tx_power": -40, "movement_counter": uint8(0), "mac": "CBB8334C884F",
+			}},
+		{name: "RAWv2 invalid", adv: adv("058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF"),
+			decoder: "ruuvi_rawv2", fields: map[string]interface{}{}},
+		{name: "RAWv1 valid", adv: adv("03291A1ECE1EFC18F94202CA0B53"),
+			decoder: "ruuvi_rawv1", fields: map[string]interface{}{
+				"humidity_pct": 20.5, "temperature_c": 26.3, "pressure": 1027.66,
+				"acceleration_x": -1.0, "acceleration_y": -1.726, "acceleration_z": 0.714, "battery_voltage": 2.899,
+			}},
+		{name: "RAWv1 maximum", adv: adv("03FF7F63FFFF7FFF7FFF7FFFFFFF"),
+			decoder: "ruuvi_rawv1", fields: map[string]interface{}{
+				"humidity_pct": 127.5, "temperature_c": 127.99, "pressure": 1155.35,
+				"acceleration_x": 32.767, "acceleration_y": 32.767, "acceleration_z": 32.767, "battery_voltage": 65.535,
+			}},
+		{name: "RAWv1 minimum", adv: adv("0300FF6300008001800180010000"),
+			decoder: "ruuvi_rawv1", fields: map[string]interface{}{
+				"humidity_pct": 0.0, "temperature_c": -127.99, "pressure": 500.0,
+				"acceleration_x": -32.767, "acceleration_y": -32.767, "acceleration_z": -32.767, "battery_voltage": 0.0,
+			}},
+		{name: "RAWv2 too short", adv: adv("0512FC5394C37C0004FFFC040CAC364200CDCBB8334C88")},
+		{name: "RAWv1 too short", adv: adv("03291A1ECE1EFC18F94202CA0B")},
+		{name: "unknown format", adv: adv("0412FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")},
+	})
+
+	for data, want := range map[string]string{
+		"0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F": "205",
+		"057FFFFFFEFFFE7FFF7FFF7FFFFFDEFEFFFECBB8334C884F": "65534",
+		"058001000000008001800180010000000000CBB8334C884F": "0",
+		"058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF": "none",
+		"03291A1ECE1EFC18F94202CA0B53":                     "none",
+	} {
+		decode := decodeRuuviRAWv2
+		if data[:2] == "03" {
+			decode = decodeRuuviRAWv1
+		}
+		d, err := decode(Advertisement{}, 0x0499, mustHex(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := "none"
+		if d.Sequence != nil {
+			got = fmt.Sprint(*d.Sequence)
+		}
+		if got != want {
+			t.Errorf("%s: sequence %s, want %s", data, got, want)
+		}
+	}
+}
+
+// claimErrRegistry fails every claim with err.
+type claimErrRegistry struct {
+	DeviceRegistry
+	err error
+}
+
+func (r claimErrRegistry) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return false, r.err
+}
+
+// TestRuuviDeduplication checks that a RAWv2 reading received again is
+// written once, and written every time when the registry cannot tell.
+func TestRuuviDeduplication(t *testing.T) {
+	oldCfg, oldRegistry, oldSink, oldRegions, oldConns, oldHostname := cfg, registry, sink, regions, conns, hostname
+	t.Cleanup(func() {
+		cfg, registry, sink, regions, conns, hostname = oldCfg, oldRegistry, oldSink, oldRegions, oldConns, oldHostname
+	})
+
+	cfg = defaultConfig()
+	cfg.Connect.Passive = true
+	events := &eventSink{}
+	sink, hostname = events, "test-host"
+	regions = newRegionMonitor(cfg.Beacons, nil)
+	defer regions.Close()
+	var err error
+	if conns, err = newConnManager(ctx, cfg.Connect); err != nil {
+		t.Fatal(err)
+	}
+	defer conns.Close()
+
+	reading := func(seq string) Advertisement {
+		return Advertisement{
+			Time:    time.Now(),
+			Address: "CB:B8:33:4C:88:4F",
+			ManufacturerData: []bluetooth.ManufacturerDataElement{
+				{CompanyID: 0x0499, Data: mustHex(t, "0512FC5394C37C0004FFFC040CAC3642"+seq+"CBB8334C884F")},
+			},
+		}
+	}
+	written := func() (n int) {
+		for _, ev := range events.take() {
+			if d, ok := ev.(DecodedData); ok && d.Payload.Decoder == "ruuvi_rawv2" {
+				n++
+			}
+		}
+		return n
+	}
+
+	registry = newMemoryRegistry()
+	for _, tt := range []struct {
+		seq  string
+		want int
+	}{{"00CD", 1}, {"00CD", 0}, {"00CE", 1}, {"00CD", 0}} {
+		processScannedDevice(reading(tt.seq))
+		if n := written(); n != tt.want {
+			t.Errorf("sequence %s written %d times, want %d", tt.seq, n, tt.want)
+		}
+	}
+
+	registry = claimErrRegistry{newMemoryRegistry(), &BackendError{"redis", "claim", ErrCircuitOpen}}
+	for i := 0; i < 2; i++ {
+		processScannedDevice(reading("00CD"))
+		if n := written(); n != 1 {
+			t.Errorf("claim failed: written %d times, want 1", n)
+		}
+	}
+}
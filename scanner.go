@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Scanner is a source of advertisements that can also connect to the
+// devices it has seen. The tinygo bluetooth adapter is the production
+// implementation; the simulator and replay backends let the rest of the
+// pipeline run without a radio.
+type Scanner interface {
+	// Enable prepares the backend. It must be called before Scan.
+	Enable() error
+
+	// Scan calls fn for every received advertisement. It blocks until
+	// StopScan is called or the backend fails.
+	Scan(fn func(Advertisement)) error
+
+	// StopScan makes a running Scan return.
+	StopScan() error
+
+	// Connect opens a connection to a device previously seen by Scan. It
+	// gives up when ctx is done.
+	Connect(ctx context.Context, address string) (Peripheral, error)
+
+	// Close releases the backend once Scan has returned.
+	Close() error
+}
+
+// Peripheral is an open connection to a device.
+type Peripheral interface {
+	Address() string
+	DiscoverServices() ([]GATTService, error)
+	Disconnect() error
+}
+
+// GATTService is a primary service discovered on a Peripheral.
+type GATTService interface {
+	UUID() bluetooth.UUID
+	DiscoverCharacteristics() ([]GATTCharacteristic, error)
+}
+
+// GATTCharacteristic is a characteristic of a GATTService.
+type GATTCharacteristic interface {
+	UUID() bluetooth.UUID
+	GetMTU() (uint16, error)
+	Read(data []byte) (int, error)
+}
+
+var errNotConnectable = errors.New("scanner: backend cannot connect to devices")
+
+// Advertisement is a single received advertisement. Unlike
+// bluetooth.ScanResult it owns its data and stays valid after the scan
+// callback returns.
+type Advertisement struct {
+	Time             time.Time
+	Address          string
+	RandomAddress    bool
+	RSSI             int16
+	LocalName        string
+	ServiceUUIDs     []bluetooth.UUID
+	ManufacturerData []bluetooth.ManufacturerDataElement
+	ServiceData      []bluetooth.ServiceDataElement
+
+	// Decoded is filled in from the payloads before processing. It is not
+	// part of recordings.
+	Decoded []Decoded
+}
+
+// advertisementJSON is the recording format of an Advertisement, with
+// UUIDs as strings and payloads as hex.
+type advertisementJSON struct {
+	Time             time.Time           `json:"time"`
+	Address          string              `json:"address"`
+	RandomAddress    bool                `json:"random_address,omitempty"`
+	RSSI             int16               `json:"rssi"`
+	LocalName        string              `json:"local_name,omitempty"`
+	ServiceUUIDs     []string            `json:"service_uuids,omitempty"`
+	ManufacturerData map[string]hexBytes `json:"manufacturer_data,omitempty"`
+	ServiceData      map[string]hexBytes `json:"service_data,omitempty"`
+}
+
+func (a Advertisement) MarshalJSON() ([]byte, error) {
+	j := advertisementJSON{
+		Time:          a.Time,
+		Address:       a.Address,
+		RandomAddress: a.RandomAddress,
+		RSSI:          a.RSSI,
+		LocalName:     a.LocalName,
+	}
+	for _, u := range a.ServiceUUIDs {
+		j.ServiceUUIDs = append(j.ServiceUUIDs, formatUUID(u))
+	}
+	if len(a.ManufacturerData) > 0 {
+		j.ManufacturerData = make(map[string]hexBytes, len(a.ManufacturerData))
+		for _, m := range a.ManufacturerData {
+			j.ManufacturerData[fmt.Sprintf("0x%04X", m.CompanyID)] = m.Data
+		}
+	}
+	if len(a.ServiceData) > 0 {
+		j.ServiceData = make(map[string]hexBytes, len(a.ServiceData))
+		for _, s := range a.ServiceData {
+			j.ServiceData[formatUUID(s.UUID)] = s.Data
+		}
+	}
+	return json.Marshal(j)
+}
+
+func (a *Advertisement) UnmarshalJSON(b []byte) error {
+	var j advertisementJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*a = Advertisement{
+		Time:          j.Time,
+		Address:       j.Address,
+		RandomAddress: j.RandomAddress,
+		RSSI:          j.RSSI,
+		LocalName:     j.LocalName,
+	}
+	for _, s := range j.ServiceUUIDs {
+		u, err := parseUUID(s)
+		if err != nil {
+			return err
+		}
+		a.ServiceUUIDs = append(a.ServiceUUIDs, u)
+	}
+	var err error
+	if a.ManufacturerData, err = parseManufacturerData(j.ManufacturerData); err != nil {
+		return err
+	}
+	a.ServiceData, err = parseServiceData(j.ServiceData)
+	return err
+}
+
+// parseManufacturerData converts a map keyed by company id, such as
+// "0x004C", into manufacturer data elements.
+func parseManufacturerData(m map[string]hexBytes) ([]bluetooth.ManufacturerDataElement, error) {
+	var elems []bluetooth.ManufacturerDataElement
+	for k, v := range m {
+		id, err := strconv.ParseUint(k, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid company id %q", k)
+		}
+		elems = append(elems, bluetooth.ManufacturerDataElement{CompanyID: uint16(id), Data: v})
+	}
+	return elems, nil
+}
+
+// parseServiceData converts a map keyed by service UUID into service
+// data elements.
+func parseServiceData(m map[string]hexBytes) ([]bluetooth.ServiceDataElement, error) {
+	var elems []bluetooth.ServiceDataElement
+	for k, v := range m {
+		u, err := parseUUID(k)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, bluetooth.ServiceDataElement{UUID: u, Data: v})
+	}
+	return elems, nil
+}
+
+// hexBytes is a byte slice written as a hex string in JSON.
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *hexBytes) UnmarshalText(b []byte) error {
+	s := strings.ReplaceAll(strings.TrimPrefix(string(b), "0x"), " ", "")
+	v, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
+
+// parseUUID accepts full 128-bit UUIDs as well as 16-bit short forms such
+// as "180f" or "0x180F".
+func parseUUID(s string) (bluetooth.UUID, error) {
+	short := strings.TrimPrefix(strings.ToLower(s), "0x")
+	if len(short) == 4 {
+		v, err := strconv.ParseUint(short, 16, 16)
+		if err == nil {
+			return bluetooth.New16BitUUID(uint16(v)), nil
+		}
+	}
+	u, err := bluetooth.ParseUUID(s)
+	if err != nil {
+		return u, fmt.Errorf("invalid UUID %q", s)
+	}
+	return u, nil
+}
+
+// formatUUID writes SIG-assigned UUIDs in their 16-bit short form.
+func formatUUID(u bluetooth.UUID) string {
+	if u.Is16Bit() {
+		return fmt.Sprintf("%04x", u.Get16Bit())
+	}
+	return u.String()
+}
+
+// watchedServiceUUIDs are checked against every advertisement by the
+// bluetooth backend. The tinygo payload only answers HasServiceUUID for
+// structured (BlueZ, CoreBluetooth, WinRT) advertisements, so advertised
+// services outside this list are not reported.
+var watchedServiceUUIDs = []bluetooth.UUID{
+	bluetooth.ServiceUUIDGenericAccess,
+	bluetooth.ServiceUUIDDeviceInformation,
+	bluetooth.ServiceUUIDBattery,
+	bluetooth.ServiceUUIDHeartRate,
+	bluetooth.ServiceUUIDHumanInterfaceDevice,
+	bluetooth.ServiceUUIDEnvironmentalSensing,
+	bluetooth.ServiceUUIDCyclingSpeedAndCadence,
+	bluetooth.ServiceUUIDCyclingPower,
+	bluetooth.ServiceUUIDRunningSpeedAndCadence,
+	bluetooth.ServiceUUIDHealthThermometer,
+	bluetooth.ServiceUUIDNordicUART,
+	bluetooth.New16BitUUID(0xFEAA), // Eddystone
+	bluetooth.New16BitUUID(0xFCD2), // BTHome
+	bluetooth.New16BitUUID(0xFE95), // Xiaomi
+	bluetooth.New16BitUUID(0xFD6F), // Exposure Notification
+	bluetooth.New16BitUUID(0xFEE5), // Mopeka
+}
+
+// watchServiceUUID adds u to watchedServiceUUIDs unless it is there
+// already. It must be called before scanning starts.
+func watchServiceUUID(u bluetooth.UUID) {
+	for _, w := range watchedServiceUUIDs {
+		if w == u {
+			return
+		}
+	}
+	watchedServiceUUIDs = append(watchedServiceUUIDs, u)
+}
+
+// bluetoothScanner is the Scanner backed by a tinygo bluetooth.Adapter.
+type bluetoothScanner struct {
+	adapter   *bluetooth.Adapter
+	adapterID string
+
+	mu sync.Mutex
+	// seen maps the string form of an address back to the backend's
+	// address, which Connect needs.
+	seen map[string]bluetooth.Address
+}
+
+// maxSeenAddresses bounds bluetoothScanner.seen. Random resolvable
+// addresses rotate, so the map is reset rather than left to grow.
+const maxSeenAddresses = 10000
+
+func newBluetoothScanner(adapter *bluetooth.Adapter, adapterID string) *bluetoothScanner {
+	return &bluetoothScanner{
+		adapter:   adapter,
+		adapterID: adapterID,
+		seen:      make(map[string]bluetooth.Address),
+	}
+}
+
+func (s *bluetoothScanner) Enable() error {
+	return s.adapter.Enable()
+}
+
+func (s *bluetoothScanner) Scan(fn func(Advertisement)) error {
+	return s.adapter.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+		adv := newAdvertisement(result)
+		s.mu.Lock()
+		if len(s.seen) >= maxSeenAddresses {
+			s.seen = make(map[string]bluetooth.Address)
+		}
+		s.seen[adv.Address] = result.Address
+		s.mu.Unlock()
+		fn(adv)
+	})
+}
+
+func (s *bluetoothScanner) StopScan() error {
+	return s.adapter.StopScan()
+}
+
+func (s *bluetoothScanner) Connect(ctx context.Context, address string) (Peripheral, error) {
+	s.mu.Lock()
+	addr, ok := s.seen[address]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("scanner: %s has not been seen", address)
+	}
+	type result struct {
+		device bluetooth.Device
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		device, err := s.adapter.Connect(addr, bluetooth.ConnectionParams{})
+		done <- result{device, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return bluetoothPeripheral{r.device, address, s.adapterID}, nil
+	case <-ctx.Done():
+		// The adapter cannot abort a pending connection, so drop it as
+		// soon as it is established.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.device.Disconnect()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *bluetoothScanner) Close() error { return nil }
+
+// newAdvertisement copies result, whose payload is only valid during the
+// scan callback.
+func newAdvertisement(result bluetooth.ScanResult) Advertisement {
+	adv := Advertisement{
+		Time:          time.Now(),
+		Address:       result.Address.String(),
+		RandomAddress: result.Address.IsRandom(),
+		RSSI:          result.RSSI,
+		LocalName:     result.LocalName(),
+	}
+	for _, u := range watchedServiceUUIDs {
+		if result.HasServiceUUID(u) {
+			adv.ServiceUUIDs = append(adv.ServiceUUIDs, u)
+		}
+	}
+	for _, m := range result.ManufacturerData() {
+		m.Data = append([]byte(nil), m.Data...)
+		adv.ManufacturerData = append(adv.ManufacturerData, m)
+	}
+	for _, sd := range result.ServiceData() {
+		sd.Data = append([]byte(nil), sd.Data...)
+		adv.ServiceData = append(adv.ServiceData, sd)
+	}
+	return adv
+}
+
+type bluetoothPeripheral struct {
+	device    bluetooth.Device
+	address   string
+	adapterID string
+}
+
+func (p bluetoothPeripheral) Address() string { return p.address }
+
+func (p bluetoothPeripheral) GAPProperties() (string, uint16, error) {
+	return gapProperties(p.adapterID, p.address)
+}
+
+func (p bluetoothPeripheral) BatteryLevel() (uint8, bool, error) {
+	return batteryPercentage(p.adapterID, p.address)
+}
+
+func (p bluetoothPeripheral) DiscoverServices() ([]GATTService, error) {
+	srvcs, err := p.device.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]GATTService, len(srvcs))
+	for i, srvc := range srvcs {
+		services[i] = bluetoothService{srvc}
+	}
+	return services, nil
+}
+
+func (p bluetoothPeripheral) Disconnect() error {
+	return p.device.Disconnect()
+}
+
+type bluetoothService struct {
+	bluetooth.DeviceService
+}
+
+func (s bluetoothService) DiscoverCharacteristics() ([]GATTCharacteristic, error) {
+	chars, err := s.DeviceService.DiscoverCharacteristics(nil)
+	if err != nil {
+		return nil, err
+	}
+	characteristics := make([]GATTCharacteristic, len(chars))
+	for i, char := range chars {
+		characteristics[i] = char
+	}
+	return characteristics, nil
+}
+
+// newScanner returns the Scanner selected by the config.
+func newScanner(c *Config) (Scanner, error) {
+	var s Scanner
+	switch c.Scan.Backend {
+	case "bluetooth":
+		adapter, err := newAdapter(c.Bluetooth.Adapter)
+		if err != nil {
+			return nil, err
+		}
+		s = newBluetoothScanner(adapter, c.Bluetooth.Adapter)
+	case "simulator":
+		s = newSimulator(c.Scan.Simulator)
+	case "replay":
+		s = newReplayScanner(c.Scan.Replay)
+	default:
+		return nil, fmt.Errorf("unknown scan backend %q", c.Scan.Backend)
+	}
+	if c.Scan.Record != "" {
+		return newRecorder(s, c.Scan.Record)
+	}
+	return s, nil
+}
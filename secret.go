@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretCommandTimeout bounds how long a cmd: secret may take to print.
+const secretCommandTimeout = 10 * time.Second
+
+// Secret is a credential such as a password or API token. The config only
+// ever holds a reference to where the value lives, never the value
+// itself:
+//
+//	env:NAME       the environment variable NAME
+//	file:PATH      the contents of PATH, e.g. a Docker secret
+//	cred:NAME      the systemd credential NAME in $CREDENTIALS_DIRECTORY
+//	cmd:PROGRAM    the standard output of PROGRAM, split on spaces
+//
+// The reference is safe to print; the resolved value is only returned by
+// Value and is redacted everywhere else.
+type Secret struct {
+	ref   string
+	value string
+}
+
+var secretSchemes = []string{"env:", "file:", "cred:", "cmd:"}
+
+func isSecretRef(s string) bool {
+	for _, scheme := range secretSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set implements flag.Value. Literal values are refused so that secrets
+// never end up in config files, shell history or process listings.
+func (s *Secret) Set(ref string) error {
+	if ref != "" && !isSecretRef(ref) {
+		return fmt.Errorf("secrets must be a reference starting with one of %s, not a literal value",
+			strings.Join(secretSchemes, " "))
+	}
+	*s = Secret{ref: ref}
+	return nil
+}
+
+// String returns the reference, never the value.
+func (s *Secret) String() string { return s.ref }
+
+// GoString keeps %#v from printing the resolved value.
+func (s Secret) GoString() string { return fmt.Sprintf("Secret(%q)", s.ref) }
+
+// IsSet reports whether a reference was configured.
+func (s *Secret) IsSet() bool { return s.ref != "" }
+
+// Value returns the resolved secret. It is empty until resolve succeeds.
+func (s *Secret) Value() string { return s.value }
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.ref)
+}
+
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	var ref string
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return err
+	}
+	return s.Set(ref)
+}
+
+// setFromEnv handles a GOTOOTH_* override of a secret. The variable may
+// hold a reference, otherwise the variable itself is the source.
+func (s *Secret) setFromEnv(name, v string) error {
+	if isSecretRef(v) {
+		return s.Set(v)
+	}
+	return s.Set("env:" + name)
+}
+
+// resolve reads the value the reference points at.
+func (s *Secret) resolve() error {
+	scheme, arg, _ := strings.Cut(s.ref, ":")
+	var v string
+	switch scheme {
+	case "":
+		return nil
+	case "env":
+		var ok bool
+		if v, ok = os.LookupEnv(arg); !ok {
+			return fmt.Errorf("secret %s: environment variable is not set", s.ref)
+		}
+	case "file", "cred":
+		path := arg
+		if scheme == "cred" {
+			dir := os.Getenv("CREDENTIALS_DIRECTORY")
+			if dir == "" {
+				return fmt.Errorf("secret %s: CREDENTIALS_DIRECTORY is not set", s.ref)
+			}
+			path = filepath.Join(dir, arg)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.ref, err)
+		}
+		v = string(b)
+	case "cmd":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return fmt.Errorf("secret %s: empty command", s.ref)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.ref, err)
+		}
+		v = string(b)
+	}
+	v = strings.TrimRight(v, "\r\n")
+	if v == "" {
+		return fmt.Errorf("secret %s: value is empty", s.ref)
+	}
+	s.value = v
+	return nil
+}
+
+// TLSConfig holds client TLS options for a backend connection.
+type TLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (t TLSConfig) validate(name string) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s.tls: cert_file and key_file must be set together", name)
+	}
+	return nil
+}
+
+// build returns the tls.Config for t, or nil when TLS is disabled.
+func (t TLSConfig) build() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// secrets returns every secret in c, keyed by its config path.
+func (c *Config) secrets() map[string]*Secret {
+	secrets := map[string]*Secret{
+		"redis.password": &c.Redis.Password,
+		"influx.token":   &c.Influx.Token,
+	}
+	for name, keys := range c.Decode.keySets() {
+		for addr, s := range keys {
+			if s != nil {
+				secrets["decode."+name+"["+addr+"]"] = s
+			}
+		}
+	}
+	return secrets
+}
+
+// resolveSecrets reads every configured secret.
+func (c *Config) resolveSecrets() error {
+	var errs []error
+	for name, s := range c.secrets() {
+		if err := s.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dump writes c as JSON with secrets shown as references and any
+// credentials in URLs removed.
+func (c *Config) dump() ([]byte, error) {
+	d := *c
+	d.Influx.URL = redactURL(d.Influx.URL)
+	return json.MarshalIndent(&d, "", "\t")
+}
+
+// redactURL replaces the password in a URL's userinfo.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// SimulatorConfig describes the virtual fleet produced by the simulator
+// scan backend.
+type SimulatorConfig struct {
+	// Seed makes generated addresses and RSSI noise reproducible.
+	Seed int64 `json:"seed"`
+
+	// Fleet lists groups of identical virtual devices.
+	Fleet []SimGroupConfig `json:"fleet"`
+}
+
+// SimGroupConfig is a group of Count virtual devices that share their
+// advertisement contents and RSSI behaviour.
+type SimGroupConfig struct {
+	Count int `json:"count"`
+
+	// Address is used verbatim when Count is 1. Otherwise addresses are
+	// generated as random static addresses.
+	Address string `json:"address"`
+
+	// Name is the local name; a %d verb is replaced by the device index.
+	Name string `json:"name"`
+
+	ManufacturerData map[string]hexBytes `json:"manufacturer_data"`
+	ServiceData      map[string]hexBytes `json:"service_data"`
+	ServiceUUIDs     []string            `json:"service_uuids"`
+
+	// Interval between advertisements of each device.
+	Interval Duration `json:"interval"`
+
+	RSSI SimRSSIConfig `json:"rssi"`
+
+	// ConnectFailureRate is the probability in [0, 1] that a connection
+	// attempt fails.
+	ConnectFailureRate float64 `json:"connect_failure_rate"`
+
+	// GATT is the service tree returned on connection. When empty a
+	// Generic Access service with the device name is served.
+	GATT []SimServiceConfig `json:"gatt"`
+}
+
+// SimRSSIConfig shapes the signal strength of a simulated device.
+//
+//	static  Mean plus Jitter
+//	walk    a random walk that stays within Mean±Amplitude
+//	sine    Mean+Amplitude·sin(2πt/Period), as if walking past
+//
+// Dropout is the probability that an advertisement is not received.
+type SimRSSIConfig struct {
+	Pattern   string   `json:"pattern"`
+	Mean      int      `json:"mean"`
+	Amplitude int      `json:"amplitude"`
+	Period    Duration `json:"period"`
+	Jitter    int      `json:"jitter"`
+	Dropout   float64  `json:"dropout"`
+}
+
+type SimServiceConfig struct {
+	UUID            string                    `json:"uuid"`
+	Characteristics []SimCharacteristicConfig `json:"characteristics"`
+}
+
+type SimCharacteristicConfig struct {
+	UUID  string   `json:"uuid"`
+	Value hexBytes `json:"value"`
+}
+
+func (c SimulatorConfig) validate() error {
+	var errs []error
+	for i, g := range c.Fleet {
+		if g.Count < 1 {
+			errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].count must be at least 1", i))
+		}
+		if g.Address != "" && g.Count > 1 {
+			errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].address requires count 1", i))
+		}
+		switch g.RSSI.Pattern {
+		case "", "static", "walk", "sine":
+		default:
+			errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].rssi.pattern %q is not static, walk or sine", i, g.RSSI.Pattern))
+		}
+		if _, err := parseManufacturerData(g.ManufacturerData); err != nil {
+			errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].manufacturer_data: %w", i, err))
+		}
+		if _, err := parseServiceData(g.ServiceData); err != nil {
+			errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].service_data: %w", i, err))
+		}
+		for _, s := range g.ServiceUUIDs {
+			if _, err := parseUUID(s); err != nil {
+				errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d]: %w", i, err))
+			}
+		}
+		for _, s := range g.GATT {
+			if _, err := parseUUID(s.UUID); err != nil {
+				errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].gatt: %w", i, err))
+			}
+			for _, ch := range s.Characteristics {
+				if _, err := parseUUID(ch.UUID); err != nil {
+					errs = append(errs, fmt.Errorf("scan.simulator.fleet[%d].gatt: %w", i, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultSimulatorFleet is used when no fleet is configured.
+var defaultSimulatorFleet = []SimGroupConfig{
+	{
+		Count:    5,
+		Name:     "sim-sensor-%d",
+		Interval: Duration(time.Second),
+		RSSI:     SimRSSIConfig{Pattern: "walk", Mean: -70, Amplitude: 15, Jitter: 3},
+		ManufacturerData: map[string]hexBytes{
+			"0xFFFF": {0x01, 0x02, 0x03},
+		},
+	},
+	{
+		Count:    2,
+		Interval: Duration(2 * time.Second),
+		RSSI:     SimRSSIConfig{Pattern: "sine", Mean: -75, Amplitude: 20, Period: Duration(time.Minute), Dropout: 0.2},
+	},
+}
+
+// simulator is a Scanner that produces advertisements for a fleet of
+// virtual devices.
+type simulator struct {
+	// mu guards everything below, including the device state that the
+	// scan loop advances.
+	mu      sync.Mutex
+	devices []*simDevice
+	rand    *rand.Rand
+	stop    chan struct{}
+}
+
+type simDevice struct {
+	adv      Advertisement
+	group    *SimGroupConfig
+	interval time.Duration
+	next     time.Time
+
+	// phase offsets the sine pattern; rssi is the random walk position.
+	phase float64
+	rssi  float64
+}
+
+func newSimulator(c SimulatorConfig) *simulator {
+	s := &simulator{rand: rand.New(rand.NewSource(c.Seed))}
+	fleet := c.Fleet
+	if len(fleet) == 0 {
+		fleet = defaultSimulatorFleet
+	}
+	start := time.Now()
+	n := 0
+	for gi := range fleet {
+		g := &fleet[gi]
+		for i := 0; i < g.Count; i++ {
+			n++
+			d := &simDevice{
+				group:    g,
+				interval: time.Duration(g.Interval),
+				phase:    s.rand.Float64() * 2 * math.Pi,
+				rssi:     float64(g.RSSI.Mean),
+			}
+			if d.interval <= 0 {
+				d.interval = time.Second
+			}
+			d.next = start.Add(time.Duration(s.rand.Int63n(int64(d.interval))))
+			d.adv.Address = g.Address
+			if d.adv.Address == "" {
+				d.adv.Address = s.randomAddress()
+				d.adv.RandomAddress = true
+			}
+			if strings.Contains(g.Name, "%") {
+				d.adv.LocalName = fmt.Sprintf(g.Name, n)
+			} else {
+				d.adv.LocalName = g.Name
+			}
+			for _, u := range g.ServiceUUIDs {
+				uuid, _ := parseUUID(u)
+				d.adv.ServiceUUIDs = append(d.adv.ServiceUUIDs, uuid)
+			}
+			// Both were checked by validate.
+			d.adv.ManufacturerData, _ = parseManufacturerData(g.ManufacturerData)
+			d.adv.ServiceData, _ = parseServiceData(g.ServiceData)
+			s.devices = append(s.devices, d)
+		}
+	}
+	return s
+}
+
+// randomAddress returns a random static address: the two most
+// significant bits are set.
+func (s *simulator) randomAddress() string {
+	var b [6]byte
+	s.rand.Read(b[:])
+	b[0] |= 0xC0
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", b[0], b[1], b[2], b[3], b[4], b[5])
+}
+
+func (s *simulator) Enable() error { return nil }
+
+// simTick is the scheduling resolution of the simulator.
+const simTick = 20 * time.Millisecond
+
+func (s *simulator) Scan(fn func(Advertisement)) error {
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		return errors.New("simulator: already scanning")
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(simTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case now := <-ticker.C:
+			// fn may call StopScan, so it runs without the lock held.
+			for _, adv := range s.due(now) {
+				fn(adv)
+			}
+		}
+	}
+}
+
+// due returns the advertisements of every device whose interval has
+// elapsed at now.
+func (s *simulator) due(now time.Time) []Advertisement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var advs []Advertisement
+	for _, d := range s.devices {
+		if now.Before(d.next) {
+			continue
+		}
+		d.next = now.Add(d.interval)
+		if s.rand.Float64() < d.group.RSSI.Dropout {
+			continue
+		}
+		adv := d.adv
+		adv.Time = now
+		adv.RSSI = s.rssi(d, now)
+		advs = append(advs, adv)
+	}
+	return advs
+}
+
+func (s *simulator) rssi(d *simDevice, now time.Time) int16 {
+	r := d.group.RSSI
+	v := float64(r.Mean)
+	switch r.Pattern {
+	case "walk":
+		d.rssi += s.rand.NormFloat64() * 2
+		d.rssi = math.Max(float64(r.Mean-r.Amplitude), math.Min(float64(r.Mean+r.Amplitude), d.rssi))
+		v = d.rssi
+	case "sine":
+		period := time.Duration(r.Period)
+		if period <= 0 {
+			period = time.Minute
+		}
+		t := float64(now.UnixNano()) / float64(period)
+		v += float64(r.Amplitude) * math.Sin(2*math.Pi*t+d.phase)
+	}
+	if r.Jitter > 0 {
+		v += float64(s.rand.Intn(2*r.Jitter+1) - r.Jitter)
+	}
+	return int16(math.Max(-127, math.Min(0, math.Round(v))))
+}
+
+func (s *simulator) StopScan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return errors.New("simulator: not scanning")
+	}
+	close(s.stop)
+	s.stop = nil
+	return nil
+}
+
+func (s *simulator) Connect(ctx context.Context, address string) (Peripheral, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, d := range s.devices {
+		if d.adv.Address != address {
+			continue
+		}
+		s.mu.Lock()
+		fail := s.rand.Float64() < d.group.ConnectFailureRate
+		s.mu.Unlock()
+		if fail {
+			return nil, fmt.Errorf("simulator: connection to %s failed", address)
+		}
+		return &simPeripheral{device: d}, nil
+	}
+	return nil, fmt.Errorf("simulator: unknown device %s", address)
+}
+
+func (s *simulator) Close() error { return nil }
+
+type simPeripheral struct {
+	device *simDevice
+}
+
+func (p *simPeripheral) Address() string { return p.device.adv.Address }
+
+func (p *simPeripheral) DiscoverServices() ([]GATTService, error) {
+	tree := p.device.group.GATT
+	if len(tree) == 0 {
+		tree = []SimServiceConfig{{
+			UUID: formatUUID(bluetooth.ServiceUUIDGenericAccess),
+			Characteristics: []SimCharacteristicConfig{{
+				UUID:  formatUUID(bluetooth.CharacteristicUUIDDeviceName),
+				Value: hexBytes(p.device.adv.LocalName),
+			}},
+		}}
+	}
+	services := make([]GATTService, len(tree))
+	for i, s := range tree {
+		uuid, _ := parseUUID(s.UUID)
+		services[i] = simService{uuid: uuid, config: s}
+	}
+	return services, nil
+}
+
+func (p *simPeripheral) Disconnect() error { return nil }
+
+type simService struct {
+	uuid   bluetooth.UUID
+	config SimServiceConfig
+}
+
+func (s simService) UUID() bluetooth.UUID { return s.uuid }
+
+func (s simService) DiscoverCharacteristics() ([]GATTCharacteristic, error) {
+	chars := make([]GATTCharacteristic, len(s.config.Characteristics))
+	for i, c := range s.config.Characteristics {
+		uuid, _ := parseUUID(c.UUID)
+		chars[i] = simCharacteristic{uuid: uuid, value: c.Value}
+	}
+	return chars, nil
+}
+
+type simCharacteristic struct {
+	uuid  bluetooth.UUID
+	value []byte
+}
+
+func (c simCharacteristic) UUID() bluetooth.UUID    { return c.uuid }
+func (c simCharacteristic) GetMTU() (uint16, error) { return 23, nil }
+
+func (c simCharacteristic) Read(data []byte) (int, error) {
+	return copy(data, c.value), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestSimulatorPipeline runs a simulated fleet through the pipeline into
+// a memory registry and a JSON sink, as main does, and checks what they
+// hold afterwards.
+func TestSimulatorPipeline(t *testing.T) {
+	oldCfg, oldScanner, oldRegistry, oldSink, oldPipe, oldRegions, oldConns, oldHostname :=
+		cfg, scanner, registry, sink, pipe, regions, conns, hostname
+	t.Cleanup(func() {
+		cfg, scanner, registry, sink, pipe, regions, conns, hostname =
+			oldCfg, oldScanner, oldRegistry, oldSink, oldPipe, oldRegions, oldConns, oldHostname
+	})
+
+	const (
+		goveeAddress     = "A4:C1:38:5D:41:0B"
+		switchBotAddress = "D4:BD:28:1A:9C:02"
+		interval         = Duration(30 * time.Millisecond)
+	)
+	cfg = defaultConfig()
+	cfg.Scan.Backend = "simulator"
+	cfg.Registry.Backend = "memory"
+	cfg.Sinks.Enabled = []string{"stdout"}
+	cfg.Scan.Simulator = SimulatorConfig{Seed: 1, Fleet: []SimGroupConfig{
+		{
+			Count: 1, Address: goveeAddress, Name: "GVH5075_410B", Interval: interval,
+			RSSI:             SimRSSIConfig{Mean: -60},
+			ManufacturerData: map[string]hexBytes{"0xEC88": {0x00, 0x03, 0x7c, 0x9b, 0x58, 0x00}},
+		},
+		{
+			Count: 1, Address: switchBotAddress, Interval: interval,
+			RSSI:        SimRSSIConfig{Mean: -70},
+			ServiceData: map[string]hexBytes{"fd3d": {0x54, 0x00, 0x64, 0x05, 0x96, 0x2d}},
+		},
+		{
+			Count: 3, Name: "sim-%d", Interval: interval,
+			RSSI:             SimRSSIConfig{Pattern: "walk", Mean: -80, Amplitude: 5},
+			ManufacturerData: map[string]hexBytes{"0xFFFF": {0x01}},
+		},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	hostname = "test-host"
+	registry = newMemoryRegistry()
+	sink = newJSONSink(&out, nil)
+	regions = newRegionMonitor(cfg.Beacons, nil)
+	scanner = newSimulator(cfg.Scan.Simulator)
+	var err error
+	if conns, err = newConnManager(ctx, cfg.Connect); err != nil {
+		t.Fatal(err)
+	}
+	pipe = newPipeline(cfg.Pipeline, processScannedDevice)
+	scanDone := make(chan error, 1)
+	go func() { scanDone <- scanner.Scan(pipe.Enqueue) }()
+
+	// Scan until every device was seen a few times and the Govee
+	// sensor, which the default policy connects to, was interrogated.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		recs, err := registry.RecentlySeen(ctx, time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, profileErr := registry.Profile(ctx, goveeAddress)
+		done := len(recs) == 5 && profileErr == nil
+		for _, rec := range recs {
+			done = done && rec.SeenCount >= 3
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after 10s: %d devices, Govee profile: %v", len(recs), profileErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := scanner.StopScan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-scanDone; err != nil {
+		t.Fatal(err)
+	}
+	pipe.Close()
+	conns.Close()
+	regions.Close()
+
+	recs, err := registry.RecentlySeen(ctx, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int64)
+	for _, rec := range recs {
+		seen[rec.Address] = rec.SeenCount
+	}
+
+	govee, err := registry.Get(ctx, goveeAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if govee.Name() != "GVH5075_410B" || len(govee.Vendors) != 1 || govee.Vendors[0] != "Govee" {
+		t.Errorf("Govee record: name %q, vendors %v", govee.Name(), govee.Vendors)
+	}
+	if d, ok := govee.Decoded["govee_h5075"]; !ok || !equalFields(d.Fields, map[string]interface{}{
+		"temperature_c": 22.8, "humidity_pct": 50.7, "battery_pct": 88.0,
+	}) {
+		t.Errorf("Govee record: decoded %+v", govee.Decoded)
+	}
+	if govee.InterrogatedAt.IsZero() {
+		t.Error("Govee record: not interrogated")
+	}
+	switchBot, err := registry.Get(ctx, switchBotAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := switchBot.Decoded["switchbot_meter"]; !ok || switchBot.LastRSSI != -70 {
+		t.Errorf("SwitchBot record: decoded %+v, RSSI %d", switchBot.Decoded, switchBot.LastRSSI)
+	}
+
+	// Every advertisement yields an observation, and those of the
+	// sensors a reading as well.
+	observations := make(map[string]int64)
+	readings := make(map[string]int64)
+	s := bufio.NewScanner(&out)
+	for s.Scan() {
+		var ev jsonEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %v", s.Bytes(), err)
+		}
+		if ev.Tags["host"] != "test-host" {
+			t.Errorf("%s: host tag missing", s.Bytes())
+		}
+		switch ev.Measurement {
+		case "device":
+			observations[ev.Tags["address"]]++
+			if ev.Tags["address"] == goveeAddress && ev.Tags["vendor"] != "Govee" {
+				t.Errorf("%s: want vendor Govee", s.Bytes())
+			}
+		case "sensor":
+			readings[ev.Tags["address"]+" "+ev.Tags["decoder"]]++
+			if ev.Fields["temperature_c"] == nil {
+				t.Errorf("%s: no temperature", s.Bytes())
+			}
+		default:
+			t.Errorf("unexpected event %s", s.Bytes())
+		}
+	}
+	for addr, n := range seen {
+		if observations[addr] != n {
+			t.Errorf("%s: %d observations written, %d seen", addr, observations[addr], n)
+		}
+	}
+	if len(observations) != len(seen) {
+		t.Errorf("observations of %d devices written, %d seen", len(observations), len(seen))
+	}
+	if readings[goveeAddress+" govee_h5075"] != seen[goveeAddress] ||
+		readings[switchBotAddress+" switchbot_meter"] != seen[switchBotAddress] || len(readings) != 2 {
+		t.Errorf("readings written %v, seen %v", readings, seen)
+	}
+}
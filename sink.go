@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	influxlog "github.com/influxdata/influxdb-client-go/v2/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Event is a typed record handed to the sinks. Every event maps onto a
+// single time-series point.
+type Event interface {
+	Measurement() string
+	Tags() map[string]string
+	Fields() map[string]interface{}
+	Timestamp() time.Time
+}
+
+// Observation is emitted for every received advertisement.
+type Observation struct {
+	Time    time.Time
+	Host    string
+	Address string
+	RSSI    int16
+
+	// Vendor is the company of the first manufacturer data, if known.
+	Vendor string
+}
+
+func (o Observation) Measurement() string { return "device" }
+
+func (o Observation) Tags() map[string]string {
+	tags := map[string]string{"strength": "dBm", "address": o.Address, "host": o.Host}
+	if o.Vendor != "" {
+		tags["vendor"] = o.Vendor
+	}
+	return tags
+}
+
+func (o Observation) Fields() map[string]interface{} {
+	return map[string]interface{}{"last": o.RSSI}
+}
+
+func (o Observation) Timestamp() time.Time { return o.Time }
+
+// Sink is a destination for events.
+type Sink interface {
+	Write(ctx context.Context, ev Event) error
+
+	// Close flushes any buffered events and releases the sink.
+	Close() error
+}
+
+// writeEvent writes ev to sink and logs a failure to l. A full buffer
+// and an open circuit are counted where they happen and not logged for
+// every event.
+func writeEvent(l *logrus.Entry, ev Event) {
+	err := sink.Write(ctx, ev)
+	if err != nil && !errors.Is(err, errInfluxBufferFull) && !errors.Is(err, ErrCircuitOpen) {
+		l.WithError(err).WithField("measurement", ev.Measurement()).Warn("write event failed")
+	}
+}
+
+// newSink returns a Sink that writes to every sink enabled in the config.
+func newSink(c *Config) (Sink, error) {
+	var sinks multiSink
+	for _, name := range c.Sinks.Enabled {
+		var s Sink
+		var err error
+		switch name {
+		case "influx":
+			s, err = newInfluxSink(c.Influx, c.Spool)
+		case "stdout":
+			s = newJSONSink(os.Stdout, nil)
+		case "file":
+			var f *os.File
+			f, err = os.OpenFile(c.Sinks.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			s = newJSONSink(f, f)
+		case "none":
+			s = nopSink{}
+		default:
+			err = fmt.Errorf("unknown sink %q", name)
+		}
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// multiSink writes every event to all of its sinks.
+type multiSink []Sink
+
+func (m multiSink) Write(ctx context.Context, ev Event) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(ctx, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// influxSink writes events to InfluxDB in the background. Write only
+// enqueues the point into a bounded buffer, so a slow or unreachable
+// server never blocks the caller. Batching and retries with exponential
+// backoff are left to the client's non-blocking WriteAPI.
+//
+// With a spool configured, batches that fail and points that do not fit
+// the buffer are appended to the spool instead, and replayed in order
+// once the server answers again. Without one they are dropped and
+// counted. After write errors in a row a circuit breaker skips the
+// server altogether until it answers a ping.
+type influxSink struct {
+	client   influxdb2.Client
+	http     *nethttp.Client
+	write    api.WriteAPI
+	blocking api.WriteAPIBlocking
+	queue    chan *write.Point
+	done     chan struct{}
+
+	breaker        *breaker
+	spool          *Spool
+	batchSize      int
+	replayInterval time.Duration
+	stopReplay     chan struct{}
+	replayDone     chan struct{}
+}
+
+func newInfluxSink(c InfluxConfig, sc SpoolConfig) (*influxSink, error) {
+	tlsConfig, err := c.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	opts := influxdb2.DefaultOptions().
+		SetBatchSize(c.BatchSize).
+		SetFlushInterval(uint(time.Duration(c.FlushInterval).Milliseconds())).
+		SetMaxRetries(c.MaxRetries).
+		SetRetryInterval(uint(time.Duration(c.RetryInterval).Milliseconds())).
+		SetMaxRetryInterval(uint(time.Duration(c.MaxRetryInterval).Milliseconds())).
+		SetRetryBufferLimit(c.RetryBufferLimit).
+		SetHTTPRequestTimeout(uint(time.Duration(c.Timeout).Seconds()))
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	breaker := newBreaker("influx", c.Breaker, sinkLog)
+	// Built from the options above before the doer replaces it.
+	httpClient := opts.HTTPOptions().HTTPClient()
+	opts.HTTPOptions().SetHTTPDoer(influxWriteDoer{httpClient, breaker})
+	if sc.Dir != "" {
+		// A failed batch goes to the spool on its first failure, which
+		// the client only reports while retries are enabled. This
+		// overrides influx.max_retries, as documented there.
+		opts.SetMaxRetries(1)
+	}
+	// Write errors are reported through the Errors channel instead of the
+	// client's own logger.
+	influxlog.Log = nil
+	client := influxdb2.NewClientWithOptions(c.URL, c.Token.Value(), opts)
+	s := &influxSink{
+		client:   client,
+		http:     httpClient,
+		write:    client.WriteAPI(c.Org, c.Bucket),
+		blocking: client.WriteAPIBlocking(c.Org, c.Bucket),
+		queue:    make(chan *write.Point, c.BufferSize),
+		done:     make(chan struct{}),
+
+		breaker:        breaker,
+		batchSize:      int(c.BatchSize),
+		replayInterval: time.Duration(sc.ReplayInterval),
+		stopReplay:     make(chan struct{}),
+		replayDone:     make(chan struct{}),
+	}
+	if sc.Dir != "" {
+		if s.spool, err = openSpool(sc, "influx", sinkLog); err != nil {
+			client.Close()
+			return nil, err
+		}
+		s.write.SetWriteFailedCallback(s.writeFailed)
+	}
+	go s.replay()
+	go s.reportErrors(s.write.Errors())
+	go s.run()
+	return s, nil
+}
+
+func (s *influxSink) Write(ctx context.Context, ev Event) error {
+	p := influxdb2.NewPoint(ev.Measurement(), ev.Tags(), ev.Fields(), ev.Timestamp())
+	open := s.breaker.isOpen()
+	if !open {
+		select {
+		case s.queue <- p:
+			metrics.Add("influx_points_queued", 1)
+			return nil
+		default:
+		}
+	}
+	if s.spool == nil {
+		metrics.Add("influx_points_dropped", 1)
+		if open {
+			return &BackendError{"influx", "write", ErrCircuitOpen}
+		}
+		return errInfluxBufferFull
+	}
+	return s.spool.Append([]byte(write.PointToLineProtocol(p, time.Nanosecond)))
+}
+
+var errInfluxBufferFull = errors.New("influx: buffer full, point dropped")
+
+// run hands queued points to the WriteAPI, which may block while a batch
+// is being sent.
+func (s *influxSink) run() {
+	defer close(s.done)
+	for p := range s.queue {
+		s.write.WritePoint(p)
+	}
+}
+
+func (s *influxSink) reportErrors(errs <-chan error) {
+	for err := range errs {
+		s.breaker.Failure()
+		metrics.Add("influx_write_errors", 1)
+		sinkLog.WithError(err).Warn("influx write failed")
+	}
+}
+
+// influxWriteDoer sends the requests of the InfluxDB client and counts
+// every successful write as a success of breaker. The WriteAPI only
+// reports the batches that fail, so failures would otherwise add up
+// across successful writes.
+type influxWriteDoer struct {
+	doer    http.Doer
+	breaker *breaker
+}
+
+func (d influxWriteDoer) Do(req *nethttp.Request) (*nethttp.Response, error) {
+	resp, err := d.doer.Do(req)
+	if err == nil && resp.StatusCode/100 == 2 && strings.HasSuffix(req.URL.Path, "/api/v2/write") {
+		d.breaker.Success()
+	}
+	return resp, err
+}
+
+// writeFailed is called by the WriteAPI when a batch fails with a
+// retryable error. The batch moves to the spool and is dropped by the
+// client.
+func (s *influxSink) writeFailed(batch string, err http.Error, retryAttempts uint) bool {
+	var lines [][]byte
+	for _, l := range strings.Split(batch, "\n") {
+		if l != "" {
+			lines = append(lines, []byte(l))
+		}
+	}
+	if err := s.spool.Append(lines...); err != nil {
+		sinkLog.WithError(err).Error("spooling failed influx batch")
+		return true
+	}
+	return false
+}
+
+// replay periodically probes the server while the circuit is open or
+// the spool holds points, and writes the spool back once the server is
+// reachable.
+func (s *influxSink) replay() {
+	defer close(s.replayDone)
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopReplay:
+			return
+		case <-ticker.C:
+		}
+		if !s.breaker.isOpen() && (s.spool == nil || s.spool.Empty()) {
+			continue
+		}
+		if !s.breaker.Allow() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.replayInterval)
+		if ok, _ := s.client.Ping(ctx); !ok {
+			s.breaker.Failure()
+		} else {
+			s.breaker.Success()
+			if s.spool != nil {
+				err := s.spool.Replay(s.batchSize, func(records [][]byte) error {
+					return s.writeSpooled(ctx, records)
+				})
+				if err != nil {
+					sinkLog.WithError(err).Warn("replaying influx spool failed")
+				}
+			}
+		}
+		cancel()
+	}
+}
+
+// writeSpooled writes spooled lines. Lines the server rejects as invalid
+// are dropped so they cannot block the spool forever.
+func (s *influxSink) writeSpooled(ctx context.Context, records [][]byte) error {
+	lines := make([]string, len(records))
+	for i, r := range records {
+		lines[i] = string(r)
+	}
+	err := s.blocking.WriteRecord(ctx, lines...)
+	var herr *http.Error
+	if errors.As(err, &herr) && herr.StatusCode >= 400 && herr.StatusCode < 500 && herr.StatusCode != 429 {
+		metrics.Add("influx_spooled_points_rejected", int64(len(lines)))
+		sinkLog.WithError(err).WithField("points", len(lines)).Error("influx rejected spooled points, dropping them")
+		return nil
+	}
+	return err
+}
+
+func (s *influxSink) Close() error {
+	close(s.stopReplay)
+	<-s.replayDone
+	close(s.queue)
+	<-s.done
+	s.write.Flush()
+	s.client.Close()
+	// The client leaves a client it did not create open.
+	s.http.CloseIdleConnections()
+	if s.spool != nil {
+		return s.spool.Close()
+	}
+	return nil
+}
+
+// jsonSink writes one JSON object per event and line.
+type jsonSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+type jsonEvent struct {
+	Measurement string                 `json:"measurement"`
+	Time        time.Time              `json:"time"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+func newJSONSink(w io.Writer, closer io.Closer) *jsonSink {
+	return &jsonSink{enc: json.NewEncoder(w), closer: closer}
+}
+
+func (s *jsonSink) Write(ctx context.Context, ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(jsonEvent{
+		Measurement: ev.Measurement(),
+		Time:        ev.Timestamp(),
+		Tags:        ev.Tags(),
+		Fields:      ev.Fields(),
+	})
+}
+
+func (s *jsonSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// nopSink discards every event.
+type nopSink struct{}
+
+func (nopSink) Write(ctx context.Context, ev Event) error { return nil }
+func (nopSink) Close() error                              { return nil }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errSink fails every write with err.
+type errSink struct{ err error }
+
+func (s errSink) Write(ctx context.Context, ev Event) error { return s.err }
+func (s errSink) Close() error                              { return nil }
+
+func TestWriteEvent(t *testing.T) {
+	old := sink
+	t.Cleanup(func() { sink = old })
+
+	ev := Observation{Time: time.Now(), Host: "test-host", Address: "C4:7C:8D:6A:1B:2E", RSSI: -70}
+	for _, tt := range []struct {
+		name   string
+		err    error
+		logged bool
+	}{
+		{"written", nil, false},
+		{"buffer full", errInfluxBufferFull, false},
+		{"circuit open", &BackendError{"influx", "write", ErrCircuitOpen}, false},
+		{"failed", &BackendError{"influx", "write", errors.New("connection refused")}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&out)
+			sink = errSink{tt.err}
+			writeEvent(logrus.NewEntry(logger), ev)
+			if logged := out.Len() > 0; logged != tt.logged {
+				t.Fatalf("logged %q, want a message: %v", out.String(), tt.logged)
+			}
+			if tt.logged && !strings.Contains(out.String(), "connection refused") {
+				t.Errorf("logged %q without the error", out.String())
+			}
+		})
+	}
+}
+
+// TestInfluxBreakerSuccess checks that a successful write resets the
+// failures counted by the circuit breaker, so only failures in a row
+// open it.
+func TestInfluxBreakerSuccess(t *testing.T) {
+	// 400 Bad Request is not retried, so every failed batch is
+	// reported once.
+	statuses := make(chan int, 4)
+	for _, code := range []int{400, 400, 204, 400} {
+		statuses <- code
+	}
+	handled := make(chan struct{}, 4)
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		code := <-statuses
+		w.WriteHeader(code)
+		if code != 204 {
+			fmt.Fprint(w, `{"code":"invalid","message":"bad point"}`)
+		}
+		handled <- struct{}{}
+	}))
+	defer srv.Close()
+
+	c := defaultConfig().Influx
+	c.URL = srv.URL
+	c.BatchSize = 1
+	c.Breaker = BreakerConfig{Failures: 3, Cooldown: Duration(time.Minute)}
+	s, err := newInfluxSink(c, SpoolConfig{ReplayInterval: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	failures := func() int {
+		s.breaker.mu.Lock()
+		defer s.breaker.mu.Unlock()
+		return s.breaker.failures
+	}
+	for i, want := range []int{1, 2, 0, 1} {
+		ev := Observation{Time: time.Now(), Host: "test-host", Address: "C4:7C:8D:6A:1B:2E", RSSI: int16(-60 - i)}
+		if err := s.Write(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("write %d not sent after 5s", i)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for failures() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("after write %d: %d failures, want %d", i, failures(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if s.breaker.isOpen() {
+		t.Error("circuit open after 3 failures that were not in a row")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SpoolConfig configures the on-disk spool that holds writes while a
+// backend is unreachable.
+type SpoolConfig struct {
+	// Dir is the spool directory; each backend gets a subdirectory. Empty
+	// disables spooling.
+	Dir string `json:"dir"`
+
+	// MaxSegmentBytes is the size at which a new segment file is started.
+	MaxSegmentBytes int64 `json:"max_segment_bytes"`
+
+	// MaxBytes and MaxAge bound the spool of each backend. The oldest
+	// segments are deleted, and their records lost, once either is
+	// exceeded. Zero disables the limit.
+	MaxBytes int64    `json:"max_bytes"`
+	MaxAge   Duration `json:"max_age"`
+
+	// ReplayInterval is how often an unreachable backend is probed.
+	ReplayInterval Duration `json:"replay_interval"`
+}
+
+func (c SpoolConfig) validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	var errs []error
+	if c.MaxSegmentBytes <= 0 {
+		errs = append(errs, errors.New("spool.max_segment_bytes must be positive"))
+	}
+	if c.MaxBytes < 0 || c.MaxAge < 0 {
+		errs = append(errs, errors.New("spool.max_bytes and spool.max_age must not be negative"))
+	}
+	if c.ReplayInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("spool.replay_interval must be at least 1s"))
+	}
+	return errors.Join(errs...)
+}
+
+const spoolSegmentExt = ".seg"
+
+// Spool is a durable FIFO of newline-terminated records. Records are
+// appended to numbered segment files in a directory and replayed oldest
+// first, so nothing is lost across restarts.
+type Spool struct {
+	name   string
+	dir    string
+	config SpoolConfig
+	log    *logrus.Entry
+
+	mu sync.Mutex
+	// seq is the number of the segment being appended to.
+	seq  uint64
+	cur  *os.File
+	size int64
+	// segs are the closed segments, oldest first, so that Append can
+	// enforce the limits without reading the directory. rotate reads
+	// them again in case a segment changed behind the spool's back.
+	segs []spoolSegment
+}
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	modTime time.Time
+}
+
+// openSpool opens or creates the spool named name below c.Dir.
+func openSpool(c SpoolConfig, name string, log *logrus.Entry) (*Spool, error) {
+	dir := filepath.Join(c.Dir, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	s := &Spool{name: name, dir: dir, config: c, log: log.WithField("spool", name)}
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+	if len(s.segs) > 0 {
+		s.seq = s.segs[len(s.segs)-1].seq
+	}
+	// Never append to a segment left by a previous run; it may end in a
+	// partial record.
+	s.seq++
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// segments returns the sequence numbers of all segments, oldest first.
+func (s *Spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	var segs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seq)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// scan reads the sizes and ages of the segments in the directory into
+// s.segs. It must be called with s.mu held and no segment open, or before
+// s is shared.
+func (s *Spool) scan() error {
+	seqs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	s.segs = s.segs[:0]
+	for _, seq := range seqs {
+		fi, err := os.Stat(s.segmentPath(seq))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed by a concurrent Replay.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("spool: %w", err)
+		}
+		s.segs = append(s.segs, spoolSegment{seq: seq, size: fi.Size(), modTime: fi.ModTime()})
+	}
+	return nil
+}
+
+// updateSegment records that the closed segment seq now holds size
+// bytes, or was removed if size is negative.
+func (s *Spool) updateSegment(seq uint64, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.segs {
+		if s.segs[i].seq != seq {
+			continue
+		}
+		if size < 0 {
+			s.segs = append(s.segs[:i], s.segs[i+1:]...)
+		} else {
+			s.segs[i].size = size
+		}
+		return
+	}
+}
+
+// Append adds records to the spool. Records must not contain newlines.
+func (s *Spool) Append(records ...[]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		f, err := os.OpenFile(s.segmentPath(s.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("spool: %w", err)
+		}
+		s.cur, s.size = f, 0
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	n, err := s.cur.Write(buf.Bytes())
+	s.size += int64(n)
+	if err == nil {
+		err = s.cur.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	metrics.Add("spool_"+s.name+"_appended", int64(len(records)))
+	if s.size >= s.config.MaxSegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	return s.enforceLimits()
+}
+
+// rotate closes the current segment so the next Append starts a new one.
+// It must be called with s.mu held.
+func (s *Spool) rotate() error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur, s.size = nil, 0
+	s.seq++
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	return s.scan()
+}
+
+// enforceLimits deletes the oldest closed segments beyond MaxBytes or
+// MaxAge. It must be called with s.mu held.
+func (s *Spool) enforceLimits() error {
+	total := s.size
+	for _, g := range s.segs {
+		total += g.size
+	}
+	for len(s.segs) > 0 {
+		g := s.segs[0]
+		tooBig := s.config.MaxBytes > 0 && total > s.config.MaxBytes
+		tooOld := s.config.MaxAge > 0 && time.Since(g.modTime) > time.Duration(s.config.MaxAge)
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(s.segmentPath(g.seq)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("spool: %w", err)
+		}
+		s.segs = s.segs[1:]
+		total -= g.size
+		metrics.Add("spool_"+s.name+"_segments_dropped", 1)
+		s.log.WithField("segment", g.seq).Warn("dropped spool segment over size or age limit")
+	}
+	return nil
+}
+
+// Empty reports whether the spool holds no records.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 {
+		return false
+	}
+	for _, g := range s.segs {
+		if g.size > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Replay passes the spooled records, oldest first and at most batch at a
+// time, to fn. Records are removed once fn accepts them. Replay stops at
+// the first error and keeps the rejected records for the next attempt.
+func (s *Spool) Replay(batch int, fn func(records [][]byte) error) error {
+	s.mu.Lock()
+	segs := make([]uint64, len(s.segs))
+	for i, g := range s.segs {
+		segs[i] = g.seq
+	}
+	s.mu.Unlock()
+	for _, seq := range segs {
+		if err := s.replaySegment(seq, batch, fn); err != nil {
+			return err
+		}
+	}
+
+	// Everything closed has been replayed; close the current segment and
+	// replay it too. Records appended meanwhile wait for the next call.
+	s.mu.Lock()
+	if s.size == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	seq := s.seq
+	err := s.rotate()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.replaySegment(seq, batch, fn)
+}
+
+func (s *Spool) replaySegment(seq uint64, batch int, fn func(records [][]byte) error) error {
+	path := s.segmentPath(seq)
+	records, err := readRecords(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Dropped by enforceLimits in the meantime.
+		s.updateSegment(seq, -1)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for len(records) > 0 {
+		n := batch
+		if n > len(records) {
+			n = len(records)
+		}
+		if err := fn(records[:n]); err != nil {
+			// Keep what is left so accepted records are not replayed twice.
+			size, werr := writeRecords(path, records)
+			if werr == nil {
+				s.updateSegment(seq, size)
+			}
+			return errors.Join(err, werr)
+		}
+		metrics.Add("spool_"+s.name+"_replayed", int64(n))
+		records = records[n:]
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("spool: %w", err)
+	}
+	s.updateSegment(seq, -1)
+	return nil
+}
+
+func readRecords(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	defer f.Close()
+	var records [][]byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) > 0 {
+			records = append(records, append([]byte(nil), sc.Bytes()...))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("spool: %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// writeRecords atomically replaces path with records and returns its new
+// size.
+func writeRecords(path string, records [][]byte) (int64, error) {
+	tmp := path + ".tmp"
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return 0, fmt.Errorf("spool: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("spool: %w", err)
+	}
+	return int64(buf.Len()), nil
+}
+
+// Close closes the segment being appended to.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func spoolRecords(t *testing.T, s *Spool, batch int) []string {
+	t.Helper()
+	var got []string
+	err := s.Replay(batch, func(records [][]byte) error {
+		for _, r := range records {
+			got = append(got, string(r))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSpool(t *testing.T) {
+	// Records are "record NN" plus a newline: 10 bytes, so every second
+	// Append starts a new segment.
+	c := SpoolConfig{Dir: t.TempDir(), MaxSegmentBytes: 20, MaxBytes: 60, ReplayInterval: Duration(time.Second)}
+	s, err := openSpool(c, "test", sinkLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Empty() {
+		t.Fatal("new spool is not empty")
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("record %02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 100 bytes were appended; the two oldest segments went over the
+	// limit.
+	if len(s.segs) != 3 {
+		t.Errorf("%d closed segments, want 3", len(s.segs))
+	}
+
+	// A failed batch keeps the rest of the segment.
+	calls := 0
+	err = s.Replay(1, func(records [][]byte) error {
+		if calls++; calls == 2 {
+			return errors.New("backend down")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Replay did not return the error of fn")
+	}
+	if s.segs[0].size != 10 {
+		t.Errorf("partly replayed segment holds %d bytes, want 10", s.segs[0].size)
+	}
+	if err := s.Append([]byte("record 10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened spool finds the segments left behind.
+	s, err = openSpool(c, "test", sinkLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Empty() {
+		t.Fatal("reopened spool is empty")
+	}
+	want := []string{"record 05", "record 06", "record 07", "record 08", "record 09", "record 10"}
+	if got := spoolRecords(t, s, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	if !s.Empty() || len(s.segs) != 0 {
+		t.Errorf("replayed spool not empty: %+v", s.segs)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("replayed spool left %v, %v", entries, err)
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	c := SpoolConfig{Dir: t.TempDir(), MaxSegmentBytes: 10, MaxAge: Duration(time.Hour), ReplayInterval: Duration(time.Second)}
+	s, err := openSpool(c, "test", sinkLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]byte("record 00")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(s.segmentPath(s.segs[0].seq), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// Ages are only read from the directory on rotation.
+	if err := s.Append([]byte("record 01")); err != nil {
+		t.Fatal(err)
+	}
+	if got := spoolRecords(t, s, 10); !reflect.DeepEqual(got, []string{"record 01"}) {
+		t.Errorf("replayed %q, want the record younger than max_age", got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+// SwitchBot service data, under 0xFD3D or the legacy 0x0D00, starts with
+// the device type in the low 7 bits. Newer firmware also repeats the
+// readings in manufacturer data of 0x0969, which is not decoded.
+const (
+	switchBotMeter     = 'T'
+	switchBotMeterPlus = 'i'
+	switchBotContact   = 'd'
+)
+
+// decodeSwitchBotMeter decodes the service data of the Meter and Meter
+// Plus: the battery in % in the low 7 bits of byte 2, the tenths of the
+// temperature in the low nibble of byte 3, the whole degrees in the low
+// 7 bits of byte 4 with the top bit set when positive, and the humidity
+// in %.
+//
+// For example, 22.5 °C, 45 % and 100 % battery:
+//
+//	fd3d: 54006405962d
+func decodeSwitchBotMeter(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) < 6 || (data[0]&0x7F != switchBotMeter && data[0]&0x7F != switchBotMeterPlus) {
+		return nil, nil
+	}
+	temp := float64(data[4]&0x7F) + float64(data[3]&0x0F)/10
+	if data[4]&0x80 == 0 {
+		temp = -temp
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "SwitchBot",
+		Fields: map[string]interface{}{
+			"temperature_c": temp,
+			"humidity_pct":  float64(data[5] & 0x7F),
+			"battery_pct":   float64(data[2] & 0x7F),
+		},
+	}, nil
+}
+
+// decodeSwitchBotContact decodes the service data of the contact sensor:
+// the battery in % in the low 7 bits of byte 2; motion, the contact left
+// open too long, the contact open and light in bits 7, 2, 1 and 0 of
+// byte 3; and the number of button presses in the low nibble of byte 8.
+//
+// For example, open in the light with 90 % battery and 1 button press:
+//
+//	fd3d: 64005a030000000001
+func decodeSwitchBotContact(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) < 9 || data[0]&0x7F != switchBotContact {
+		return nil, nil
+	}
+	return &Decoded{
+		Measurement: "sensor",
+		Vendor:      "SwitchBot",
+		Fields: map[string]interface{}{
+			"battery_pct":  float64(data[2] & 0x7F),
+			"motion":       data[3]&0x80 != 0,
+			"opening":      data[3]&0x06 != 0,
+			"light":        data[3]&0x01 != 0,
+			"button_count": int64(data[8] & 0x0F),
+		},
+	}, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDecodeSwitchBot(t *testing.T) {
+	runDecoderTests(t, "SwitchBot", []decoderTest{
+		{name: "meter", adv: `{"address":"D4:BD:28:1A:9C:02","service_data":{"fd3d":"54006405962d"}}`,
+			decoder: "switchbot_meter", fields: map[string]interface{}{"temperature_c": 22.5, "humidity_pct": 45.0, "battery_pct": 100.0}},
+		{name: "meter plus below zero on the legacy UUID", adv: `{"address":"D4:BD:28:1A:9C:02","service_data":{"0d00":"69004b03053c"}}`,
+			decoder: "switchbot_meter", fields: map[string]interface{}{"temperature_c": -5.3, "humidity_pct": 60.0, "battery_pct": 75.0}},
+		{name: "contact open in the light", adv: `{"address":"F0:5E:4B:11:7A:3D","service_data":{"fd3d":"64005a030000000001"}}`,
+			decoder: "switchbot_contact", fields: map[string]interface{}{
+				"battery_pct": 90.0, "motion": false, "opening": true, "light": true, "button_count": int64(1),
+			}},
+		{name: "contact motion", adv: `{"address":"F0:5E:4B:11:7A:3D","service_data":{"fd3d":"e4003c800000000002"}}`,
+			decoder: "switchbot_contact", fields: map[string]interface{}{
+				"battery_pct": 60.0, "motion": true, "opening": false, "light": false, "button_count": int64(2),
+			}},
+		{name: "other device", adv: `{"address":"F0:5E:4B:11:7A:3D","service_data":{"fd3d":"48000000"}}`},
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "strings"
+
+// thermoProBattery maps the 3 battery levels of the TP35x to %.
+var thermoProBattery = map[byte]float64{0: 1, 1: 50, 2: 100}
+
+// decodeThermoPro decodes the manufacturer data of the ThermoPro TP357,
+// TP358, TP359 and TP393, recognised by their local name. The readings
+// start in the company identifier: its high byte and the first data byte
+// are the little endian temperature in 0.1 °C, followed by the humidity
+// in % and the battery level.
+//
+// For example, 22.3 °C, 45 % and a full battery:
+//
+//	0xDFC2: 002d022c
+func decodeThermoPro(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if (!strings.HasPrefix(adv.LocalName, "TP35") && !strings.HasPrefix(adv.LocalName, "TP39")) || len(data) < 3 {
+		return nil, nil
+	}
+	fields := map[string]interface{}{
+		"temperature_c": float64(int16(uint16(data[0])<<8|companyID>>8)) / 10,
+		"humidity_pct":  float64(data[1]),
+	}
+	if b, ok := thermoProBattery[data[2]]; ok {
+		fields["battery_pct"] = b
+	}
+	return &Decoded{Measurement: "sensor", Vendor: "ThermoPro", Fields: fields}, nil
+}
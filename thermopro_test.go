@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestDecodeThermoPro(t *testing.T) {
+	runDecoderTests(t, "ThermoPro", []decoderTest{
+		{name: "TP357", adv: `{"address":"B8:59:CE:32:11:9D","local_name":"TP357 (119D)","manufacturer_data":{"0xDFC2":"002d022c"}}`,
+			decoder: "thermopro", fields: map[string]interface{}{"temperature_c": 22.3, "humidity_pct": 45.0, "battery_pct": 100.0}},
+		{name: "TP393 below zero", adv: `{"address":"B8:59:CE:32:11:9D","local_name":"TP393 (119D)","manufacturer_data":{"0xF6C2":"ff3c00"}}`,
+			decoder: "thermopro", fields: map[string]interface{}{"temperature_c": -1.0, "humidity_pct": 60.0, "battery_pct": 1.0}},
+		{name: "unknown battery level", adv: `{"address":"B8:59:CE:32:11:9D","local_name":"TP358 (119D)","manufacturer_data":{"0xF1C2":"001d07"}}`,
+			decoder: "thermopro", fields: map[string]interface{}{"temperature_c": 24.1, "humidity_pct": 29.0}},
+		{name: "other name", adv: `{"address":"B8:59:CE:32:11:9D","local_name":"TP25","manufacturer_data":{"0xDFC2":"002d022c"}}`},
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Victron Energy "Instant Readout" manufacturer data starts with 0x10,
+// a reserved byte, the little endian model ID, the record type, the data
+// counter and the first byte of the device's advertisement key, followed
+// by the record encrypted with AES-CTR. See Victron's "Extra manufacturer
+// data" specification.
+const (
+	victronProductAdvertisement = 0x10
+
+	victronSolarCharger   = 0x01
+	victronBatteryMonitor = 0x02
+	victronInverter       = 0x03
+	victronDCDCConverter  = 0x04
+)
+
+// victronStates names the device and charge states.
+var victronStates = map[uint64]string{
+	0:   "off",
+	1:   "low_power",
+	2:   "fault",
+	3:   "bulk",
+	4:   "absorption",
+	5:   "float",
+	6:   "storage",
+	7:   "equalize_manual",
+	8:   "passthru",
+	9:   "inverting",
+	10:  "power_assist",
+	11:  "power_supply",
+	245: "starting_up",
+	246: "repeated_absorption",
+	247: "auto_equalize",
+	248: "battery_safe",
+	252: "external_control",
+}
+
+// victronRecord returns the decrypted record of data if it is of type
+// record, or nil if it is another type.
+func victronRecord(adv Advertisement, data []byte, record byte) ([]byte, *uint32, error) {
+	if len(data) < 8 || data[0] != victronProductAdvertisement || data[4] != record {
+		return nil, nil, nil
+	}
+	key, err := bindKey(cfg.Decode.VictronKeys, adv.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("victron: %w", err)
+	}
+	if data[7] != key[0] {
+		return nil, nil, errors.New("victron: advertisement key does not match")
+	}
+	counter := binary.LittleEndian.Uint16(data[5:])
+	seq := uint32(counter)
+	return victronDecrypt(key, counter, data[8:]), &seq, nil
+}
+
+// victronDecrypt decrypts with AES-CTR whose counter block is the data
+// counter as a 128-bit little endian number. cipher.NewCTR counts big
+// endian, so the counter is stepped here.
+func victronDecrypt(key []byte, counter uint16, ciphertext []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	ctr := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint16(ctr, counter)
+	stream := make([]byte, aes.BlockSize)
+	plaintext := make([]byte, len(ciphertext))
+	for i := range ciphertext {
+		if i%aes.BlockSize == 0 {
+			block.Encrypt(stream, ctr)
+			for j := range ctr {
+				if ctr[j]++; ctr[j] != 0 {
+					break
+				}
+			}
+		}
+		plaintext[i] = ciphertext[i] ^ stream[i%aes.BlockSize]
+	}
+	return plaintext
+}
+
+// victronBits reads the little endian bit fields of a record, least
+// significant bit first. Reading past the end yields all ones, which the
+// records use for values that are not available.
+type victronBits struct {
+	data []byte
+	pos  int
+}
+
+func (b *victronBits) uint(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := uint64(1)
+		if byteIndex := (b.pos + i) / 8; byteIndex < len(b.data) {
+			bit = uint64(b.data[byteIndex]>>((b.pos+i)%8)) & 1
+		}
+		v |= bit << i
+	}
+	b.pos += n
+	return v
+}
+
+func (b *victronBits) int(n int) int64 {
+	shift := 64 - n
+	return int64(b.uint(n)<<shift) >> shift
+}
+
+// victronDecoded returns the sensor readings of a record of a Victron
+// device.
+func victronDecoded(data []byte, seq *uint32, fields map[string]interface{}) *Decoded {
+	return &Decoded{
+		Measurement: "victron",
+		Tags:        map[string]string{"model_id": fmt.Sprintf("0x%04x", binary.LittleEndian.Uint16(data[2:]))},
+		Fields:      fields,
+		Sequence:    seq,
+	}
+}
+
+// setState sets field to the name of state, or its number if unknown.
+// 0xFF means not available.
+func setState(fields map[string]interface{}, field string, state uint64) {
+	if state == 0xFF {
+		return
+	}
+	if name, ok := victronStates[state]; ok {
+		fields[field] = name
+	} else {
+		fields[field] = fmt.Sprint(state)
+	}
+}
+
+// decodeVictronSolarCharger decodes a solar charger record: the charge
+// state, the charger error, the battery voltage in 10 mV and current in
+// 0.1 A, the yield today in 0.01 kWh, the PV power in W and the load
+// current in 0.1 A.
+func decodeVictronSolarCharger(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	rec, seq, err := victronRecord(adv, data, victronSolarCharger)
+	if rec == nil {
+		return nil, err
+	}
+	b := &victronBits{data: rec}
+	fields := make(map[string]interface{})
+	setState(fields, "charge_state", b.uint(8))
+	fields["charger_error"] = int64(b.uint(8))
+	if v := b.int(16); v != 0x7FFF {
+		fields["battery_voltage"] = float64(v) / 100
+	}
+	if v := b.int(16); v != 0x7FFF {
+		fields["battery_current"] = float64(v) / 10
+	}
+	if v := b.uint(16); v != 0xFFFF {
+		fields["yield_today"] = float64(v) / 100
+	}
+	if v := b.uint(16); v != 0xFFFF {
+		fields["pv_power"] = int64(v)
+	}
+	if v := b.uint(9); v != 0x1FF {
+		fields["load_current"] = float64(v) / 10
+	}
+	return victronDecoded(data, seq, fields), nil
+}
+
+// victronAuxInputs name the auxiliary input value of a battery monitor
+// record.
+var victronAuxInputs = []string{"starter_voltage", "midpoint_voltage", "temperature"}
+
+// decodeVictronBatteryMonitor decodes a battery monitor record: the time
+// to go in minutes, the battery voltage in 10 mV, the alarm reason, the
+// auxiliary input and its mode, the current in mA, the consumed Ah in
+// 0.1 Ah and the state of charge in 0.1 %.
+func decodeVictronBatteryMonitor(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	rec, seq, err := victronRecord(adv, data, victronBatteryMonitor)
+	if rec == nil {
+		return nil, err
+	}
+	b := &victronBits{data: rec}
+	fields := make(map[string]interface{})
+	if v := b.uint(16); v != 0xFFFF {
+		fields["remaining_minutes"] = int64(v)
+	}
+	if v := b.int(16); v != 0x7FFF {
+		fields["battery_voltage"] = float64(v) / 100
+	}
+	fields["alarm"] = int64(b.uint(16))
+	aux := b.uint(16)
+	switch mode := b.uint(2); mode {
+	case 0:
+		// The starter voltage is signed.
+		if v := int16(aux); v != 0x7FFF {
+			fields[victronAuxInputs[mode]] = float64(v) / 100
+		}
+	case 1:
+		if aux != 0xFFFF {
+			fields[victronAuxInputs[mode]] = float64(aux) / 100
+		}
+	case 2:
+		// Kelvin in 0.01 K.
+		if aux != 0xFFFF {
+			fields[victronAuxInputs[mode]] = float64(aux)/100 - 273.15
+		}
+	}
+	if v := b.int(22); v != 0x1FFFFF {
+		fields["battery_current"] = float64(v) / 1000
+	}
+	if v := b.uint(20); v != 0xFFFFF {
+		fields["consumed_ah"] = -float64(v) / 10
+	}
+	if v := b.uint(10); v != 0x3FF {
+		fields["state_of_charge"] = float64(v) / 10
+	}
+	return victronDecoded(data, seq, fields), nil
+}
+
+// decodeVictronInverter decodes an inverter record: the device state,
+// the alarm reason, the battery voltage in 10 mV, the AC apparent power
+// in VA, the AC voltage in 10 mV and the AC current in 0.1 A.
+func decodeVictronInverter(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	rec, seq, err := victronRecord(adv, data, victronInverter)
+	if rec == nil {
+		return nil, err
+	}
+	b := &victronBits{data: rec}
+	fields := make(map[string]interface{})
+	setState(fields, "device_state", b.uint(8))
+	fields["alarm"] = int64(b.uint(16))
+	if v := b.int(16); v != 0x7FFF {
+		fields["battery_voltage"] = float64(v) / 100
+	}
+	if v := b.uint(16); v != 0xFFFF {
+		fields["ac_apparent_power"] = int64(v)
+	}
+	if v := b.uint(15); v != 0x7FFF {
+		fields["ac_voltage"] = float64(v) / 100
+	}
+	if v := b.uint(11); v != 0x7FF {
+		fields["ac_current"] = float64(v) / 10
+	}
+	return victronDecoded(data, seq, fields), nil
+}
+
+// decodeVictronDCDCConverter decodes a DC-DC converter record, such as
+// an Orion's: the device state, the charger error, the input and output
+// voltages in 10 mV and the off reason.
+func decodeVictronDCDCConverter(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	rec, seq, err := victronRecord(adv, data, victronDCDCConverter)
+	if rec == nil {
+		return nil, err
+	}
+	b := &victronBits{data: rec}
+	fields := make(map[string]interface{})
+	setState(fields, "device_state", b.uint(8))
+	fields["charger_error"] = int64(b.uint(8))
+	if v := b.uint(16); v != 0xFFFF {
+		fields["input_voltage"] = float64(v) / 100
+	}
+	if v := b.int(16); v != 0x7FFF {
+		fields["output_voltage"] = float64(v) / 100
+	}
+	fields["off_reason"] = int64(b.uint(32))
+	return victronDecoded(data, seq, fields), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"testing"
+)
+
+// victronBitWriter packs little endian bit fields, least significant bit
+// first, as the records are laid out.
+type victronBitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *victronBitWriter) put(n int, v uint64) {
+	for i := 0; i < n; i++ {
+		if w.pos/8 == len(w.data) {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.pos/8] |= byte(v>>i&1) << (w.pos % 8)
+		w.pos++
+	}
+}
+
+// sealVictron encrypts record as a device with key would, with one AES
+// block per 16 bytes whose counter block is counter + i as a little endian
+// 128-bit number, and returns the advertisement.
+func sealVictron(t *testing.T, key []byte, model uint16, recordType byte, counter uint16, record []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{victronProductAdvertisement, 0, byte(model), byte(model >> 8), recordType, byte(counter), byte(counter >> 8), key[0]}
+	for i := 0; i < len(record); i += aes.BlockSize {
+		ctr := make([]byte, aes.BlockSize)
+		binary.LittleEndian.PutUint32(ctr, uint32(counter)+uint32(i/aes.BlockSize))
+		stream := make([]byte, aes.BlockSize)
+		block.Encrypt(stream, ctr)
+		for j := i; j < len(record) && j < i+aes.BlockSize; j++ {
+			data = append(data, record[j]^stream[j-i])
+		}
+	}
+	return data
+}
+
+func TestVictronBits(t *testing.T) {
+	b := &victronBits{data: mustHex(t, "f1ff7f0280")}
+	if v := b.uint(4); v != 0x1 {
+		t.Errorf("uint(4) = %#x, want 0x1", v)
+	}
+	if v := b.uint(4); v != 0xf {
+		t.Errorf("uint(4) = %#x, want 0xf", v)
+	}
+	if v := b.int(16); v != 0x7fff {
+		t.Errorf("int(16) = %#x, want 0x7fff", v)
+	}
+	if v := b.int(2); v != -2 {
+		t.Errorf("int(2) = %d, want -2", v)
+	}
+	if v := b.uint(6); v != 0 {
+		t.Errorf("uint(6) = %d, want 0", v)
+	}
+	// 7 bits of 0x80 then 5 past the end, which read as ones.
+	if v := b.uint(12); v != 0xf80 {
+		t.Errorf("uint(12) = %#x, want 0xf80", v)
+	}
+}
+
+func TestVictronDecrypt(t *testing.T) {
+	key := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	plaintext := bytes.Repeat([]byte{0x5a}, 40)
+	// 0xFFFF steps the counter block into its third byte.
+	for _, counter := range []uint16{0, 0x1234, 0xFFFF} {
+		data := sealVictron(t, key, 0xa389, victronBatteryMonitor, counter, plaintext)
+		if got := victronDecrypt(key, counter, data[8:]); !bytes.Equal(got, plaintext) {
+			t.Errorf("counter %#x: decrypted %x, want %x", counter, got, plaintext)
+		}
+	}
+}
+
+func TestDecodeVictron(t *testing.T) {
+	const (
+		solarAddress   = "F4:11:6D:AB:BC:01"
+		batteryAddress = "F4:11:6D:AB:BC:02"
+		// No published inverter or DC-DC converter frames were at hand;
+		// the records of this device are sealed with sealVictron.
+		synthesizedAddress = "F4:11:6D:AB:BC:03"
+		synthesizedKey     = "000102030405060708090a0b0c0d0e0f"
+	)
+	testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.VictronKeys = k }, map[string]string{
+		// The victron-ble project's test advertisements.
+		solarAddress:       "adeccb947395801a4dd45a2eaa44bf17",
+		batteryAddress:     "aff4d0995b7d1e176c0c33ecb9e70dcd",
+		synthesizedAddress: synthesizedKey,
+	})
+	key := mustHex(t, synthesizedKey)
+
+	inverter := &victronBitWriter{}
+	inverter.put(8, 9)     // inverting
+	inverter.put(16, 0)    // no alarm
+	inverter.put(16, 1285) // 12.85 V
+	inverter.put(16, 250)  // 250 VA
+	inverter.put(15, 23000)
+	inverter.put(11, 11) // 1.1 A
+
+	dcdc := &victronBitWriter{}
+	dcdc.put(8, 3)     // bulk
+	dcdc.put(8, 0)     // no error
+	dcdc.put(16, 1320) // 13.2 V
+	dcdc.put(16, 1260) // 12.6 V
+	dcdc.put(32, 0x00000020)
+
+	monitor := &victronBitWriter{}
+	monitor.put(16, 600)        // 10 hours
+	monitor.put(16, 1310)       // 13.1 V
+	monitor.put(16, 0)          // no alarm
+	monitor.put(16, 29815)      // 25 °C in 0.01 K
+	monitor.put(2, 2)           // temperature
+	monitor.put(22, 1<<22-2500) // -2.5 A
+	monitor.put(20, 125)        // 12.5 Ah
+	monitor.put(10, 875)        // 87.5 %
+
+	unavailable := &victronBitWriter{}
+	unavailable.put(8, 0xFF)
+	unavailable.put(16, 0)
+	unavailable.put(16, 0x7FFF)
+	unavailable.put(16, 0xFFFF)
+	unavailable.put(15, 0x7FFF)
+	unavailable.put(11, 0x7FF)
+
+	tests := []struct {
+		name    string
+		address string
+		decode  func(Advertisement, uint16, []byte) (*Decoded, error)
+		data    []byte
+		fields  map[string]interface{}
+		model   string
+		seq     uint32
+	}{
+		{"solar charger", solarAddress, decodeVictronSolarCharger,
+			mustHex(t, "100242a0016207adceb37b605d7e0ee21b24df5c"), map[string]interface{}{
+				"charge_state": "absorption", "charger_error": int64(0), "battery_voltage": 13.88,
+				"battery_current": 1.4, "yield_today": 0.03, "pv_power": int64(19), "load_current": 0.0,
+			}, "0xa042", 1890},
+		{"battery monitor", batteryAddress, decodeVictronBatteryMonitor,
+			mustHex(t, "100289a302b040af925d09a4d89aa0128bdef48c6298a9"), map[string]interface{}{
+				"battery_voltage": 12.53, "alarm": int64(0),
+				"battery_current": 0.0, "consumed_ah": -50.0, "state_of_charge": 50.0,
+			}, "0xa389", 16560},
+		{"battery monitor temperature", synthesizedAddress, decodeVictronBatteryMonitor,
+			sealVictron(t, key, 0xa389, victronBatteryMonitor, 42, monitor.data), map[string]interface{}{
+				"remaining_minutes": int64(600), "battery_voltage": 13.1, "alarm": int64(0), "temperature": 25.0,
+				"battery_current": -2.5, "consumed_ah": -12.5, "state_of_charge": 87.5,
+			}, "0xa389", 42},
+		{"inverter", synthesizedAddress, decodeVictronInverter,
+			sealVictron(t, key, 0xa2a1, victronInverter, 0x0102, inverter.data), map[string]interface{}{
+				"device_state": "inverting", "alarm": int64(0), "battery_voltage": 12.85,
+				"ac_apparent_power": int64(250), "ac_voltage": 230.0, "ac_current": 1.1,
+			}, "0xa2a1", 0x0102},
+		{"inverter values not available", synthesizedAddress, decodeVictronInverter,
+			sealVictron(t, key, 0xa2a1, victronInverter, 7, unavailable.data), map[string]interface{}{
+				"alarm": int64(0),
+			}, "0xa2a1", 7},
+		{"dc-dc converter", synthesizedAddress, decodeVictronDCDCConverter,
+			sealVictron(t, key, 0xa3c0, victronDCDCConverter, 0xfffe, dcdc.data), map[string]interface{}{
+				"device_state": "bulk", "charger_error": int64(0), "input_voltage": 13.2,
+				"output_voltage": 12.6, "off_reason": int64(0x20),
+			}, "0xa3c0", 0xfffe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adv := Advertisement{Address: tt.address}
+			d, err := tt.decode(adv, 0x02E1, tt.data)
+			if err != nil || d == nil {
+				t.Fatalf("decoded %+v, %v", d, err)
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+			if d.Tags["model_id"] != tt.model {
+				t.Errorf("model_id = %q, want %q", d.Tags["model_id"], tt.model)
+			}
+			if d.Sequence == nil || *d.Sequence != tt.seq {
+				t.Errorf("sequence = %v, want %d", d.Sequence, tt.seq)
+			}
+
+			wrongKey := append([]byte{}, tt.data...)
+			wrongKey[7]++
+			if _, err := tt.decode(adv, 0x02E1, wrongKey); err == nil {
+				t.Error("decoded a record for another key")
+			}
+			if _, err := tt.decode(Advertisement{Address: "F4:11:6D:AB:BC:FF"}, 0x02E1, tt.data); err == nil {
+				t.Error("decoded a record without a key for the address")
+			}
+		})
+	}
+
+	// Each decoder leaves the other record types alone.
+	data := mustHex(t, "100242a0016207adceb37b605d7e0ee21b24df5c")
+	for _, decode := range []func(Advertisement, uint16, []byte) (*Decoded, error){
+		decodeVictronBatteryMonitor, decodeVictronInverter, decodeVictronDCDCConverter,
+	} {
+		if d, err := decode(Advertisement{Address: solarAddress}, 0x02E1, data); d != nil || err != nil {
+			t.Errorf("decoded a solar charger record as %+v, %v", d, err)
+		}
+	}
+}
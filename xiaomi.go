@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// MiBeacon frame control flags. The version is in the top 4 bits; v4 and
+// v5 encrypt with AES-CCM, earlier versions with a scheme not supported
+// here.
+const (
+	miBeaconEncrypted  = 0x0008
+	miBeaconMAC        = 0x0010
+	miBeaconCapability = 0x0020
+	miBeaconObjects    = 0x0040
+)
+
+// miBeaconModels names the product IDs of common devices.
+var miBeaconModels = map[uint16]string{
+	0x0098: "HHCCJCY01",
+	0x01AA: "LYWSDCGQ",
+	0x0347: "CGG1",
+	0x045B: "LYWSD02",
+	0x055B: "LYWSD03MMC",
+}
+
+// decodeMiBeacon decodes Xiaomi MiBeacon service data: the little endian
+// frame control, product ID and frame counter, optionally the sender's
+// MAC address (reversed) and capabilities, and objects of a 2-byte type,
+// a length and a value. Encrypted objects are followed by a 3-byte
+// extension of the frame counter and a 4-byte message integrity check.
+func decodeMiBeacon(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) < 5 {
+		return nil, nil
+	}
+	control := binary.LittleEndian.Uint16(data)
+	version := control >> 12
+	if control&miBeaconObjects == 0 {
+		// Pairing and capability frames carry no readings.
+		return nil, nil
+	}
+	pos := 5
+	var mac []byte
+	if control&miBeaconMAC != 0 {
+		pos += 6
+		if len(data) < pos {
+			return nil, errors.New("mibeacon: frame too short for MAC address")
+		}
+		mac = data[5:pos]
+	}
+	if control&miBeaconCapability != 0 {
+		if len(data) < pos+1 {
+			return nil, errors.New("mibeacon: frame too short for capabilities")
+		}
+		// Capability bit 5 adds 2 bytes of I/O capabilities.
+		if data[pos]&0x20 != 0 {
+			pos += 2
+		}
+		pos++
+	}
+	if len(data) < pos {
+		return nil, errors.New("mibeacon: frame too short for capabilities")
+	}
+
+	product := binary.LittleEndian.Uint16(data[2:])
+	seq := uint32(data[4])
+	objects := data[pos:]
+	if control&miBeaconEncrypted != 0 {
+		if version < 4 {
+			return nil, fmt.Errorf("mibeacon: v%d encryption is not supported", version)
+		}
+		var err error
+		if objects, seq, err = decryptMiBeacon(adv.Address, mac, data[:5], objects); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Decoded{
+		Measurement: "sensor",
+		Tags:        map[string]string{"product_id": fmt.Sprintf("0x%04x", product)},
+		Fields:      make(map[string]interface{}),
+		Sequence:    &seq,
+	}
+	if model, ok := miBeaconModels[product]; ok {
+		d.Tags["model"] = model
+	}
+	for len(objects) > 0 {
+		if len(objects) < 3 || len(objects) < 3+int(objects[2]) {
+			return nil, errors.New("mibeacon: object truncated")
+		}
+		typ, value := binary.LittleEndian.Uint16(objects), objects[3:3+int(objects[2])]
+		objects = objects[3+len(value):]
+		if err := decodeMiBeaconObject(d, typ, value); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// decryptMiBeacon decrypts the objects of a v4 or v5 frame. The AES-CCM
+// nonce is the MAC address as sent, the product ID, the frame counter
+// and its extension, and the additional data is the single byte 0x11.
+// It returns the objects and the full 32-bit frame counter.
+func decryptMiBeacon(address string, mac, header, payload []byte) ([]byte, uint32, error) {
+	key, err := bindKey(cfg.Decode.MiBeaconKeys, address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("mibeacon: %w", err)
+	}
+	if len(payload) < 8 {
+		return nil, 0, errors.New("mibeacon: encrypted payload too short")
+	}
+	if mac == nil {
+		b, err := addressBytes(address)
+		if err != nil {
+			return nil, 0, fmt.Errorf("mibeacon: %w", err)
+		}
+		for i := range b {
+			mac = append(mac, b[len(b)-1-i])
+		}
+	}
+	n := len(payload)
+	ciphertext, ext, mic := payload[:n-7], payload[n-7:n-4], payload[n-4:]
+	nonce := append(append(append([]byte{}, mac...), header[2:5]...), ext...)
+	objects, err := ccmOpen(key, nonce, ciphertext, mic, []byte{0x11})
+	if err != nil {
+		return nil, 0, fmt.Errorf("mibeacon: %w", err)
+	}
+	counter := uint32(header[4]) | uint32(ext[0])<<8 | uint32(ext[1])<<16 | uint32(ext[2])<<24
+	return objects, counter, nil
+}
+
+// miBeaconButtonEvents names the press types of object 0x1001.
+var miBeaconButtonEvents = []string{"press", "double_press", "long_press", "triple_press"}
+
+// miBeaconObjectSizes are the minimum value sizes of the object types
+// decoded.
+var miBeaconObjectSizes = map[uint16]int{
+	0x1001: 3, 0x1004: 2, 0x1006: 2, 0x1007: 3, 0x1008: 1, 0x1009: 2,
+	0x100A: 1, 0x100D: 4, 0x1010: 2, 0x1013: 1, 0x1014: 1, 0x1015: 1,
+	0x1017: 4, 0x1018: 1, 0x1019: 1, 0x4803: 1, 0x4C01: 4, 0x4C02: 1,
+	0x4C08: 4,
+}
+
+// decodeMiBeaconObject adds the values of an object to d. Unknown object
+// types are skipped.
+func decodeMiBeaconObject(d *Decoded, typ uint16, v []byte) error {
+	size, ok := miBeaconObjectSizes[typ]
+	if !ok {
+		return nil
+	}
+	if len(v) < size {
+		return fmt.Errorf("mibeacon: object 0x%04x too short: %d bytes", typ, len(v))
+	}
+	le16 := func(i int) uint16 { return binary.LittleEndian.Uint16(v[i:]) }
+	f := d.Fields
+	switch typ {
+	case 0x1001:
+		event := strconv.Itoa(int(v[2]))
+		if int(v[2]) < len(miBeaconButtonEvents) {
+			event = miBeaconButtonEvents[v[2]]
+		}
+		name := "button"
+		if i := le16(0); i > 0 {
+			name += "_" + strconv.Itoa(int(i)+1)
+		}
+		d.Events = append(d.Events, DeviceEvent{Name: name, Event: event})
+	case 0x1004:
+		f["temperature_c"] = float64(int16(le16(0))) / 10
+	case 0x1006:
+		f["humidity_pct"] = float64(le16(0)) / 10
+	// Floats throughout, as BTHome writes the same fields and a field has
+	// one type in InfluxDB.
+	case 0x1007:
+		f["illuminance"] = float64(uint32(v[0]) | uint32(v[1])<<8 | uint32(v[2])<<16)
+	case 0x1008:
+		f["moisture"] = float64(v[0])
+	case 0x1009:
+		f["conductivity"] = float64(le16(0))
+	case 0x100A, 0x4803:
+		f["battery_pct"] = float64(v[0])
+	case 0x100D:
+		f["temperature_c"] = float64(int16(le16(0))) / 10
+		f["humidity_pct"] = float64(le16(2)) / 10
+	case 0x1010:
+		f["formaldehyde"] = float64(le16(0)) / 100
+	case 0x1013:
+		f["consumable"] = int64(v[0])
+	case 0x1014:
+		f["moisture_detected"] = v[0] != 0
+	case 0x1015:
+		f["smoke"] = v[0] != 0
+	case 0x1017:
+		f["no_motion_time"] = int64(binary.LittleEndian.Uint32(v))
+	case 0x1018:
+		f["light"] = v[0] != 0
+	case 0x1019:
+		// 0 is open, 1 closed and higher values report open too long or
+		// tampering.
+		f["opening"] = v[0] != 1
+	case 0x4C01:
+		t, err := float32Value(v)
+		if err != nil {
+			return fmt.Errorf("mibeacon: object 0x%04x: %w", typ, err)
+		}
+		f["temperature_c"] = t
+	case 0x4C02:
+		f["humidity_pct"] = float64(v[0])
+	case 0x4C08:
+		h, err := float32Value(v)
+		if err != nil {
+			return fmt.Errorf("mibeacon: object 0x%04x: %w", typ, err)
+		}
+		f["humidity_pct"] = h
+	}
+	return nil
+}
+
+// float32Value reads a little endian float32, rounded to 2 decimals so
+// that 21.3 is not written as 21.299999237060547. NaN and infinities are
+// an error, since neither the sinks nor the registry can store them.
+func float32Value(v []byte) (float64, error) {
+	f := float64(math.Float32frombits(binary.LittleEndian.Uint32(v)))
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("not a number: %v", f)
+	}
+	return math.Round(f*100) / 100, nil
+}
+
+// decodeATC decodes the custom format of the ATC1441 thermometer
+// firmware: the MAC address, big endian temperature in 0.1 °C, humidity
+// and battery in %, battery voltage in mV and a frame counter.
+func decodeATC(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) != 13 {
+		return nil, nil
+	}
+	seq := uint32(data[12])
+	return &Decoded{
+		Measurement: "sensor",
+		Fields: map[string]interface{}{
+			"temperature_c":   float64(int16(binary.BigEndian.Uint16(data[6:]))) / 10,
+			"humidity_pct":    float64(data[8]),
+			"battery_pct":     float64(data[9]),
+			"battery_voltage": float64(binary.BigEndian.Uint16(data[10:])) / 1000,
+		},
+		Sequence: &seq,
+	}, nil
+}
+
+// decodePVVX decodes the custom format of the pvvx thermometer firmware:
+// the reversed MAC address, little endian temperature and humidity in
+// hundredths, battery voltage in mV, battery in %, a frame counter and
+// flags. The firmware's encrypted custom format is not supported; it can
+// advertise BTHome instead.
+func decodePVVX(adv Advertisement, companyID uint16, data []byte) (*Decoded, error) {
+	if len(data) != 15 {
+		return nil, nil
+	}
+	seq := uint32(data[13])
+	return &Decoded{
+		Measurement: "sensor",
+		Fields: map[string]interface{}{
+			"temperature_c":   float64(int16(binary.LittleEndian.Uint16(data[6:]))) / 100,
+			"humidity_pct":    float64(binary.LittleEndian.Uint16(data[8:])) / 100,
+			"battery_voltage": float64(binary.LittleEndian.Uint16(data[10:])) / 1000,
+			"battery_pct":     float64(data[12]),
+		},
+		Sequence: &seq,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	miBeaconTestAddress = "A4:C1:38:66:E5:67"
+	miBeaconTestKey     = "e9ea895fac7cca6d30532432a516f3c8"
+)
+
+// sealMiBeacon builds an encrypted frame of header (frame control,
+// product ID and frame counter), mac (reversed, or nil if not included)
+// and objects. The nonce is the reversed address, the product ID, the
+// frame counter and ext, and the additional data is 0x11. No captured
+// v4/v5 frame with a published bindkey was at hand, so the frames are
+// sealed here with the independent ccmSeal.
+func sealMiBeacon(t *testing.T, header, mac, objects, ext []byte) []byte {
+	t.Helper()
+	nonceMAC := mac
+	if nonceMAC == nil {
+		nonceMAC = mustHex(t, "67e56638c1a4")
+	}
+	nonce := append(append(append([]byte{}, nonceMAC...), header[2:5]...), ext...)
+	ciphertext, tag := ccmSeal(t, mustHex(t, miBeaconTestKey), nonce, objects, []byte{0x11}, 4)
+	frame := append(append([]byte{}, header...), mac...)
+	frame = append(append(append(frame, ciphertext...), ext...), tag...)
+	return frame
+}
+
+func TestDecodeMiBeaconEncrypted(t *testing.T) {
+	testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.MiBeaconKeys = k },
+		map[string]string{miBeaconTestAddress: miBeaconTestKey})
+	adv := Advertisement{Address: miBeaconTestAddress}
+	// Temperature 23.4 °C and battery 93 %.
+	objects := mustHex(t, "041002ea000a10015d")
+	tests := []struct {
+		name  string
+		frame []byte
+		seq   uint32
+	}{
+		// v5 with the MAC address, as sent by the LYWSD03MMC.
+		{"v5 with MAC", sealMiBeacon(t, mustHex(t, "58585b0550"), mustHex(t, "67e56638c1a4"), objects, mustHex(t, "010000")), 0x00000150},
+		// v4 without the MAC address: the nonce uses the sender's.
+		{"v4 without MAC", sealMiBeacon(t, mustHex(t, "48485b0551"), nil, objects, mustHex(t, "020304")), 0x04030251},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := decodeMiBeacon(adv, 0, tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{"temperature_c": 23.4, "battery_pct": 93.0}
+			if !equalFields(d.Fields, want) {
+				t.Errorf("fields = %v, want %v", d.Fields, want)
+			}
+			if d.Sequence == nil || *d.Sequence != tt.seq {
+				t.Errorf("sequence = %v, want %#x", d.Sequence, tt.seq)
+			}
+			if d.Tags["model"] != "LYWSD03MMC" {
+				t.Errorf("model = %q, want LYWSD03MMC", d.Tags["model"])
+			}
+
+			tampered := append([]byte{}, tt.frame...)
+			tampered[len(tampered)-5] ^= 1 // the counter extension
+			if _, err := decodeMiBeacon(adv, 0, tampered); err == nil {
+				t.Error("decoded a frame with a modified counter extension")
+			}
+			if _, err := decodeMiBeacon(Advertisement{Address: "A4:C1:38:66:E5:68"}, 0, tt.frame); err == nil {
+				t.Error("decoded a frame without a bindkey for the address")
+			}
+		})
+	}
+
+	// Frames authenticated without the additional data 0x11 are refused.
+	nonce := append(mustHex(t, "67e56638c1a45b0550"), 1, 0, 0)
+	ciphertext, tag := ccmSeal(t, mustHex(t, miBeaconTestKey), nonce, objects, nil, 4)
+	frame := append(append(append(mustHex(t, "58585b055067e56638c1a4"), ciphertext...), 1, 0, 0), tag...)
+	if _, err := decodeMiBeacon(adv, 0, frame); err == nil {
+		t.Error("decoded a frame sealed without additional data")
+	}
+}
+
+func TestDecodeMiBeacon(t *testing.T) {
+	testKeys(t, func(c *DecodeConfig, k map[string]*Secret) { c.MiBeaconKeys = k }, nil)
+	tests := []struct {
+		name   string
+		data   string
+		fields map[string]interface{}
+		events []DeviceEvent
+		err    bool
+	}{
+		// LYWSDCGQ, v2 unencrypted with the MAC address: temperature
+		// and humidity.
+		{name: "temperature and humidity", data: "5020aa0112010000a8654c0d1004ea00f401", fields: map[string]interface{}{"temperature_c": 23.4, "humidity_pct": 50.0}},
+		{name: "negative temperature", data: "40205b0501041002f6ff", fields: map[string]interface{}{"temperature_c": -1.0}},
+		{name: "illuminance and conductivity", data: "40209800010710036400000910025e01", fields: map[string]interface{}{"illuminance": 100.0, "conductivity": 350.0}},
+		{name: "moisture", data: "40209800010810012a", fields: map[string]interface{}{"moisture": 42.0}},
+		{name: "float temperature", data: "40205b0501014c04cdccac41", fields: map[string]interface{}{"temperature_c": 21.6}},
+		{name: "opening", data: "40205b0501 1910 01 00", fields: map[string]interface{}{"opening": true}},
+		{name: "unknown object skipped", data: "40205b0501ffff0201020a10015d", fields: map[string]interface{}{"battery_pct": 93.0}},
+		{name: "button", data: "40205b0501 0110 03 010002", fields: map[string]interface{}{}, events: []DeviceEvent{{Name: "button_2", Event: "long_press"}}},
+		{name: "NaN", data: "40205b0501014c040000c07f", err: true},
+		{name: "infinity", data: "40205b0501014c04000080ff", err: true},
+		{name: "truncated object", data: "40205b0501041002ea", err: true},
+		{name: "v3 encryption", data: "48305b0501041002ea00", err: true},
+		{name: "no objects", data: "10205b050167e56638c1a4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := decodeMiBeacon(Advertisement{Address: "4C:65:A8:00:00:01"}, 0, mustHex(t, compactHex(tt.data)))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("decoded %+v, want an error", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.fields == nil {
+				if d != nil {
+					t.Fatalf("decoded %+v, want nil", d)
+				}
+				return
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+			if !reflect.DeepEqual(d.Events, tt.events) {
+				t.Errorf("events = %v, want %v", d.Events, tt.events)
+			}
+		})
+	}
+}
+
+// compactHex removes the spaces that group bytes in test data.
+func compactHex(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != ' ' {
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
+func TestDecodeATCAndPVVX(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(Advertisement, uint16, []byte) (*Decoded, error)
+		data   string
+		fields map[string]interface{}
+		seq    uint32
+	}{
+		// ATC1441: MAC, 23.4 °C, 50 %, 93 %, 2950 mV, frame 7.
+		{"atc", decodeATC, "a4c13866e568 00ea 32 5d 0b86 07", map[string]interface{}{
+			"temperature_c": 23.4, "humidity_pct": 50.0, "battery_pct": 93.0, "battery_voltage": 2.95,
+		}, 7},
+		{"atc below zero", decodeATC, "a4c13866e568 ffec 5a 64 0c1c 08", map[string]interface{}{
+			"temperature_c": -2.0, "humidity_pct": 90.0, "battery_pct": 100.0, "battery_voltage": 3.1,
+		}, 8},
+		// pvvx: reversed MAC, 23.45 °C, 50.12 %, 2950 mV, 93 %, frame 8,
+		// flags.
+		{"pvvx", decodePVVX, "69e56638c1a4 2909 9413 860b 5d 08 05", map[string]interface{}{
+			"temperature_c": 23.45, "humidity_pct": 50.12, "battery_voltage": 2.95, "battery_pct": 93.0,
+		}, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := tt.decode(Advertisement{}, 0, mustHex(t, compactHex(tt.data)))
+			if err != nil || d == nil {
+				t.Fatalf("decoded %+v, %v", d, err)
+			}
+			if !equalFields(d.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", d.Fields, tt.fields)
+			}
+			if d.Sequence == nil || *d.Sequence != tt.seq {
+				t.Errorf("sequence = %v, want %d", d.Sequence, tt.seq)
+			}
+		})
+	}
+
+	// Each only recognises its own length.
+	if d, _ := decodeATC(Advertisement{}, 0, make([]byte, 15)); d != nil {
+		t.Error("atc decoded a pvvx frame")
+	}
+	if d, _ := decodePVVX(Advertisement{}, 0, make([]byte, 13)); d != nil {
+		t.Error("pvvx decoded an atc frame")
+	}
+}